@@ -0,0 +1,122 @@
+package acl
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+// ACL decides which publishers, jobs and instances are allowed
+type ACL struct {
+	allow []*rule
+	deny  []*rule
+}
+
+type rule struct {
+	publisher matcher
+	job       matcher
+	instance  matcher
+}
+
+// matcher matches a value against a glob or, when written as /pattern/, a regular expression
+type matcher func(string) bool
+
+// New compiles the rules in the configuration
+func New(cfg *config.ACLConfig) (*ACL, error) {
+	a := &ACL{}
+	var err error
+
+	a.allow, err = compileRules(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow rule: %s", err)
+	}
+
+	a.deny, err = compileRules(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny rule: %s", err)
+	}
+
+	return a, nil
+}
+
+// Allowed determines if a scrape may be pushed, any matching deny rule rejects it and
+// when allow rules are configured at least one has to match
+func (a *ACL) Allowed(publisher string, job string, instance string) bool {
+	for _, r := range a.deny {
+		if r.match(publisher, job, instance) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	for _, r := range a.allow {
+		if r.match(publisher, job, instance) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *rule) match(publisher string, job string, instance string) bool {
+	return r.publisher(publisher) && r.job(job) && r.instance(instance)
+}
+
+func compileRules(rules []*config.ACLRule) ([]*rule, error) {
+	compiled := []*rule{}
+
+	for _, r := range rules {
+		c := &rule{}
+		var err error
+
+		c.publisher, err = compile(r.Publisher)
+		if err != nil {
+			return nil, err
+		}
+
+		c.job, err = compile(r.Job)
+		if err != nil {
+			return nil, err
+		}
+
+		c.instance, err = compile(r.Instance)
+		if err != nil {
+			return nil, err
+		}
+
+		compiled = append(compiled, c)
+	}
+
+	return compiled, nil
+}
+
+func compile(pattern string) (matcher, error) {
+	if pattern == "" || pattern == "*" {
+		return func(string) bool { return true }, nil
+	}
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+
+		return re.MatchString, nil
+	}
+
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pattern, err)
+	}
+
+	return func(v string) bool {
+		ok, _ := path.Match(pattern, v)
+		return ok
+	}, nil
+}
@@ -0,0 +1,59 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+func TestAllowed(t *testing.T) {
+	cases := []struct {
+		name      string
+		allow     []*config.ACLRule
+		deny      []*config.ACLRule
+		publisher string
+		job       string
+		instance  string
+		allowed   bool
+	}{
+		{name: "no rules", publisher: "dc1", job: "web", instance: "web1", allowed: true},
+		{name: "empty rule matches all", allow: []*config.ACLRule{{}}, publisher: "dc1", job: "web", allowed: true},
+		{name: "star matches all", allow: []*config.ACLRule{{Publisher: "*"}}, publisher: "dc1", job: "web", allowed: true},
+		{name: "glob allow matches", allow: []*config.ACLRule{{Publisher: "dc*.example.net"}}, publisher: "dc1.example.net", allowed: true},
+		{name: "glob allow does not match", allow: []*config.ACLRule{{Publisher: "dc*.example.net"}}, publisher: "web.example.net", allowed: false},
+		{name: "glob is anchored", allow: []*config.ACLRule{{Job: "web"}}, job: "webserver", allowed: false},
+		{name: "regex allow matches", allow: []*config.ACLRule{{Job: "/^(web|db)$/"}}, job: "db", allowed: true},
+		{name: "regex allow does not match", allow: []*config.ACLRule{{Job: "/^(web|db)$/"}}, job: "dns", allowed: false},
+		{name: "regex is not anchored", allow: []*config.ACLRule{{Instance: "/web/"}}, instance: "mywebserver", allowed: true},
+		{name: "all fields of a rule must match", allow: []*config.ACLRule{{Publisher: "dc1", Job: "web"}}, publisher: "dc1", job: "db", allowed: false},
+		{name: "any allow rule may match", allow: []*config.ACLRule{{Job: "db"}, {Job: "web"}}, job: "web", allowed: true},
+		{name: "deny without allow", deny: []*config.ACLRule{{Job: "secret*"}}, job: "secret_job", allowed: false},
+		{name: "deny does not match", deny: []*config.ACLRule{{Job: "secret*"}}, job: "web", allowed: true},
+		{name: "deny takes precedence over glob allow", allow: []*config.ACLRule{{Publisher: "dc*"}}, deny: []*config.ACLRule{{Publisher: "dc2"}}, publisher: "dc2", allowed: false},
+		{name: "deny takes precedence over regex allow", allow: []*config.ACLRule{{Job: "/.+/"}}, deny: []*config.ACLRule{{Job: "/^internal_/"}}, job: "internal_db", allowed: false},
+		{name: "allow still applies next to deny", allow: []*config.ACLRule{{Publisher: "dc*"}}, deny: []*config.ACLRule{{Publisher: "dc2"}}, publisher: "dc1", allowed: true},
+		{name: "deny on instance only", allow: []*config.ACLRule{{}}, deny: []*config.ACLRule{{Job: "web", Instance: "web2"}}, job: "web", instance: "web2", allowed: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, err := New(&config.ACLConfig{Allow: c.allow, Deny: c.deny})
+			if err != nil {
+				t.Fatalf("could not compile rules: %s", err)
+			}
+
+			if a.Allowed(c.publisher, c.job, c.instance) != c.allowed {
+				t.Fatalf("expected allowed to be %v for %s/%s/%s", c.allowed, c.publisher, c.job, c.instance)
+			}
+		})
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, r := range []*config.ACLRule{{Job: "/(/"}, {Publisher: "[dc"}} {
+		_, err := New(&config.ACLConfig{Deny: []*config.ACLRule{r}})
+		if err == nil {
+			t.Errorf("invalid rule %+v was accepted", r)
+		}
+	}
+}
@@ -20,6 +20,23 @@ var FiveSec = BackoffPolicy{
 	[]int{500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000, 4500, 5000},
 }
 
+// TwentySec is a backoff policy ranging up to 20 seconds.
+var TwentySec = BackoffPolicy{
+	[]int{500, 1000, 2000, 3000, 5000, 7500, 10000, 12500, 15000, 17500, 20000},
+}
+
+// OneMinute is a backoff policy ranging up to a minute.
+var OneMinute = BackoffPolicy{
+	[]int{1000, 2000, 4000, 8000, 15000, 20000, 30000, 40000, 50000, 60000},
+}
+
+// Policies are the backoff policies that can be selected by name
+var Policies = map[string]BackoffPolicy{
+	"five_sec":   FiveSec,
+	"twenty_sec": TwentySec,
+	"one_minute": OneMinute,
+}
+
 // Duration returns the time duration of the n'th wait cycle in a
 // backoff policy. This is b.Millis[n], randomized to avoid thundering
 // herds.
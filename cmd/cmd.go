@@ -19,6 +19,7 @@ import (
 	"github.com/choria-io/go-security/puppetsec"
 	"github.com/choria-io/prometheus-streams/build"
 	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
 	"github.com/choria-io/prometheus-streams/receiver"
 	"github.com/choria-io/prometheus-streams/scrape"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -40,6 +41,27 @@ var (
 	enrollIdentity string
 	enrollCA       string
 	enrollDir      string
+
+	dlDir       string
+	dlTopic     string
+	dlFiles     []string
+	dlKeep      bool
+	dlStream    bool
+	dlIdle      time.Duration
+	dlSequences []uint64
+	dlAfter     uint64
+
+	replaySince     time.Duration
+	replayUntil     time.Duration
+	replayIdle      time.Duration
+	replayIgnoreAge bool
+
+	tailTopic      string
+	tailPoller     bool
+	tailDump       bool
+	tailSince      time.Duration
+	tailJobs       []string
+	tailPublishers []string
 )
 
 // Run sets up the CLI and perform the users desired actions
@@ -55,11 +77,42 @@ func Run() {
 	p := app.Command("poller", "Polls for and published Prometheus metrics")
 	r := app.Command("receiver", "Received and pushes Prometheus metrics published by the poller")
 	e := app.Command("enroll", "Enrolls with a Puppet CA")
+	sa := app.Command("standalone", "Runs an embedded Stream server, the poller and the receiver in one process")
 
 	e.Arg("identity", "Certificate Name to use when enrolling").StringVar(&enrollIdentity)
 	e.Flag("ca", "Host and port for the Puppet CA in host:port format").Default("puppet:8140").StringVar(&enrollCA)
 	e.Flag("dir", "Directory to write SSL configuration to").Required().StringVar(&enrollDir)
 
+	dl := app.Command("deadletters", "Inspect and re-inject scrapes the receiver could not deliver")
+	dll := dl.Command("list", "List stored dead letters")
+	dll.Flag("dir", "Directory holding dead letters, defaults to the configured dead_letter directory").StringVar(&dlDir)
+	dll.Flag("stream", "Read dead letters from the configured dead_letter topic instead of a directory").BoolVar(&dlStream)
+	dll.Flag("idle", "Stop reading the dead_letter topic when no letters were received for this long").Default("2s").DurationVar(&dlIdle)
+	dll.Flag("after", "Only read letters after this sequence on the dead_letter topic").Uint64Var(&dlAfter)
+	dlr := dl.Command("reinject", "Push dead letters to the output that failed or publish them back into the receiver stream")
+	dlr.Arg("files", "Specific dead letter files to re-inject, defaults to all").ExistingFilesVar(&dlFiles)
+	dlr.Flag("dir", "Directory holding dead letters, defaults to the configured dead_letter directory").StringVar(&dlDir)
+	dlr.Flag("stream", "Read dead letters from the configured dead_letter topic instead of a directory").BoolVar(&dlStream)
+	dlr.Flag("idle", "Stop reading the dead_letter topic when no letters were received for this long").Default("2s").DurationVar(&dlIdle)
+	dlr.Flag("sequence", "Sequence on the dead_letter topic of a letter to re-inject, defaults to all").Uint64ListVar(&dlSequences)
+	dlr.Flag("after", "Only re-inject letters after this sequence on the dead_letter topic, defaults to the progress recorded in reinject_state").Uint64Var(&dlAfter)
+	dlr.Flag("topic", "Topic to publish to, defaults to the subject the dead letter was received on").StringVar(&dlTopic)
+	dlr.Flag("keep", "Keep dead letters after successfully re-injecting them").BoolVar(&dlKeep)
+
+	rp := app.Command("replay", "Pushes previously published metrics from the receiver stream to the Push Gateway")
+	rp.Flag("since", "How far back to start replaying from").Required().DurationVar(&replaySince)
+	rp.Flag("until", "How far back to stop replaying, defaults to now").Default("0s").DurationVar(&replayUntil)
+	rp.Flag("idle", "Stop replaying when no messages were received for this long").Default("10s").DurationVar(&replayIdle)
+	rp.Flag("ignore-age", "Push metrics older than max_age").BoolVar(&replayIgnoreAge)
+
+	t := app.Command("tail", "Decodes and prints scrapes published to the stream")
+	t.Flag("topic", "Topic to tail, defaults to the receiver_stream topics").StringVar(&tailTopic)
+	t.Flag("poller", "Tail the poller_stream instead of the receiver_stream").BoolVar(&tailPoller)
+	t.Flag("dump", "Print the decompressed metrics").BoolVar(&tailDump)
+	t.Flag("since", "Start with messages published this long ago rather than only new ones").DurationVar(&tailSince)
+	t.Flag("job", "Only show scrapes for these jobs").StringsVar(&tailJobs)
+	t.Flag("publisher", "Only show scrapes from these publishers").StringsVar(&tailPublishers)
+
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	wg = &sync.WaitGroup{}
@@ -86,6 +139,26 @@ func Run() {
 		cfg.Debug = true
 	}
 
+	switch cmd {
+	case dll.FullCommand():
+		deadLetterList()
+		return
+	case dlr.FullCommand():
+		configureLogging()
+		deadLetterReinject()
+		return
+	case rp.FullCommand():
+		configureLogging()
+		go interrupWatcher(cancel)
+		replay()
+		return
+	case t.FullCommand():
+		configureLogging()
+		go interrupWatcher(cancel)
+		tail()
+		return
+	}
+
 	writePID(pidfile)
 	configureLogging()
 
@@ -100,6 +173,8 @@ func Run() {
 		poll()
 	case r.FullCommand():
 		receive()
+	case sa.FullCommand():
+		standalone()
 	}
 
 	err = configureManagement()
@@ -129,7 +204,7 @@ func configureManagement() error {
 		}
 	}
 
-	_, err := backplane.Run(ctx, wg, cfg.Management, opts...)
+	_, err := backplane.Run(ctx, wg, &cfg.Management.StandardConfiguration, opts...)
 	return err
 }
 
@@ -176,15 +251,30 @@ func enroll() {
 }
 
 func poll() {
+	for _, s := range cfg.PollerStreams {
+		connection.Expect("poller_"+s.Name, s)
+	}
+
 	wg.Add(1)
 	go scrape.Run(ctx, wg, cfg)
 }
 
 func receive() {
+	connection.Expect("receiver", cfg.ReceiverStream)
+
 	wg.Add(1)
 	go receiver.Run(ctx, wg, cfg)
 }
 
+func replay() {
+	now := time.Now()
+
+	err := receiver.Replay(ctx, cfg, now.Add(-replaySince), now.Add(-replayUntil), replayIdle, replayIgnoreAge)
+	if err != nil {
+		log.Fatalf("Replay failed: %s", err)
+	}
+}
+
 func interrupWatcher(cancel func()) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -235,7 +325,23 @@ func writePID(pidfile string) {
 }
 
 func setupPrometheus(port int64) {
-	log.Infof("Listening for /metrics on %d", port)
+	log.Infof("Listening for /metrics, /healthz and /readyz on %d", port)
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", statusHandler(connection.Healthy))
+	http.HandleFunc("/readyz", statusHandler(connection.Ready))
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
 }
+
+// statusHandler responds with 200 when check passes and 503 listing the problems when not
+func statusHandler(check func() (bool, []string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, problems := check()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
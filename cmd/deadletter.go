@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/choria-io/prometheus-streams/deadletter"
+	"github.com/choria-io/prometheus-streams/receiver"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func deadLetterDir() (string, error) {
+	if dlDir != "" {
+		return dlDir, nil
+	}
+
+	if cfg.DeadLetter == nil || cfg.DeadLetter.Directory == "" {
+		return "", fmt.Errorf("no dead letter directory configured, use --dir")
+	}
+
+	return cfg.DeadLetter.Directory, nil
+}
+
+// deadLetterFromTopic determines if dead letters are read from the dead letter topic,
+// either because --stream was given or because only a topic is configured
+func deadLetterFromTopic() bool {
+	if dlStream {
+		return true
+	}
+
+	if dlDir != "" || cfg.DeadLetter == nil {
+		return false
+	}
+
+	return cfg.DeadLetter.Directory == "" && cfg.DeadLetter.Topic != ""
+}
+
+// deadLetterConnection connects to the receiver stream without a client id so it
+// does not affect the receiver
+func deadLetterConnection() connection.Transport {
+	if cfg.ReceiverStream == nil {
+		kingpin.Fatalf("A receiver_stream is required to read or re-inject dead letters on the Stream")
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = log
+	}
+
+	scfg := *cfg.ReceiverStream
+	scfg.ClientID = ""
+
+	conn, err := connection.New(ctx, &scfg, cfg.Log("connector"), func(reason error) {
+		log.Fatalf("Stream connection lost while handling dead letters: %s", reason)
+	})
+	if err != nil {
+		kingpin.Fatalf("Could not connect to the Stream: %s", err)
+	}
+
+	return conn
+}
+
+// deadLetters loads dead letters from the directory or the dead letter topic, letters
+// on the topic are read after sequence after
+func deadLetters(conn connection.Transport, after uint64) []*deadletter.Letter {
+	letters := []*deadletter.Letter{}
+
+	if deadLetterFromTopic() {
+		if cfg.DeadLetter == nil || cfg.DeadLetter.Topic == "" {
+			kingpin.Fatalf("No dead letter topic configured")
+		}
+
+		fetched, err := deadletter.Fetch(ctx, conn, cfg.DeadLetter.Topic, after, dlIdle)
+		if err != nil {
+			kingpin.Fatalf("Could not read dead letters from %s: %s", cfg.DeadLetter.Topic, err)
+		}
+
+		if len(dlSequences) == 0 {
+			return fetched
+		}
+
+		wanted := make(map[uint64]bool)
+		for _, seq := range dlSequences {
+			wanted[seq] = true
+		}
+
+		for _, l := range fetched {
+			if wanted[l.Position] {
+				letters = append(letters, l)
+			}
+		}
+
+		return letters
+	}
+
+	dir, err := deadLetterDir()
+	if err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+
+	files := dlFiles
+	if len(files) == 0 {
+		files, err = deadletter.List(dir)
+		if err != nil {
+			kingpin.Fatalf("Could not list dead letters: %s", err)
+		}
+	}
+
+	for _, f := range files {
+		l, err := deadletter.Read(f)
+		if err != nil {
+			log.Errorf("%s", err)
+			continue
+		}
+
+		letters = append(letters, l)
+	}
+
+	return letters
+}
+
+// letterName identifies a dead letter by its file or its position on the dead letter topic
+func letterName(l *deadletter.Letter) string {
+	if l.File != "" {
+		return l.File
+	}
+
+	return fmt.Sprintf("%s:%d", cfg.DeadLetter.Topic, l.Position)
+}
+
+func deadLetterList() {
+	var conn connection.Transport
+
+	if deadLetterFromTopic() {
+		conn = deadLetterConnection()
+		defer conn.Close()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LETTER\tTIME\tREASON\tPUBLISHER\tJOB\tINSTANCE\tOUTPUT\tSIZE\tERROR")
+
+	for _, l := range deadLetters(conn, dlAfter) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", letterName(l), time.Unix(l.Time, 0).Format(time.RFC3339), l.Reason, l.Publisher, l.Job, l.Instance, l.Output, len(l.Data), l.Error)
+	}
+
+	w.Flush()
+}
+
+// reinjectProgress is the sequence on the dead letter topic up to which letters were
+// already re-injected, --after overrides the progress recorded in reinject_state
+func reinjectProgress() uint64 {
+	if dlAfter > 0 || len(dlSequences) > 0 || !deadLetterFromTopic() || cfg.DeadLetter.ReinjectState == "" {
+		return dlAfter
+	}
+
+	seq, err := deadletter.ReadProgress(cfg.DeadLetter.ReinjectState)
+	if err != nil {
+		kingpin.Fatalf("Could not read re-inject progress: %s", err)
+	}
+
+	return seq
+}
+
+func deadLetterReinject() {
+	conn := deadLetterConnection()
+	defer conn.Close()
+
+	after := reinjectProgress()
+
+	letters := deadLetters(conn, after)
+	if len(letters) == 0 {
+		fmt.Println("No dead letters found")
+		return
+	}
+
+	// letters that failed on an output are pushed straight to it, a receiver without
+	// dead letters ensures failures are reported here rather than stored again
+	rcfg := *cfg
+	rcfg.DeadLetter = nil
+
+	rcv, err := receiver.New(&rcfg, conn)
+	if err != nil {
+		kingpin.Fatalf("Could not set up the receiver: %s", err)
+	}
+
+	count := 0
+
+	// progress only moves past letters when all letters before them were re-injected
+	progress := after
+	failed := false
+
+	for _, l := range letters {
+		if l.Output != "" {
+			err = rcv.Redeliver(ctx, l)
+		} else {
+			err = conn.Publish(deadLetterTopic(l), l.Data)
+		}
+
+		if err != nil {
+			log.Errorf("Could not re-inject %s: %s", letterName(l), err)
+			failed = true
+			continue
+		}
+
+		count++
+
+		if !failed {
+			progress = l.Position
+		}
+
+		if !dlKeep && l.File != "" {
+			err = os.Remove(l.File)
+			if err != nil {
+				log.Errorf("Could not remove re-injected dead letter %s: %s", l.File, err)
+			}
+		}
+	}
+
+	fmt.Printf("Re-injected %d of %d dead letters\n", count, len(letters))
+
+	if deadLetterFromTopic() && len(dlSequences) == 0 && cfg.DeadLetter.ReinjectState != "" && progress > after {
+		err = deadletter.SaveProgress(cfg.DeadLetter.ReinjectState, progress)
+		if err != nil {
+			log.Errorf("Could not record re-inject progress in %s: %s", cfg.DeadLetter.ReinjectState, err)
+			return
+		}
+
+		fmt.Printf("Recorded re-inject progress up to sequence %d in %s\n", progress, cfg.DeadLetter.ReinjectState)
+	}
+}
+
+// deadLetterTopic is where a letter that was not received by any output is republished
+func deadLetterTopic(l *deadletter.Letter) string {
+	if dlTopic != "" {
+		return dlTopic
+	}
+
+	if l.Subject != "" {
+		return l.Subject
+	}
+
+	return cfg.ReceiverStream.Topic
+}
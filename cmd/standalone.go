@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	natsd "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	"github.com/nats-io/nats-streaming-server/stores"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func standalone() {
+	err := cfg.UseStandalone()
+	if err != nil {
+		kingpin.Fatalf("Could not configure standalone mode: %s", err)
+	}
+
+	sa := cfg.Standalone
+
+	switch sa.Server {
+	case "streaming":
+		err = startStreamingServer()
+	default:
+		err = startJetStreamServer()
+	}
+
+	if err != nil {
+		kingpin.Fatalf("Could not start the embedded %s server: %s", sa.Server, err)
+	}
+
+	log.Infof("Embedded %s server listening on %s:%d", sa.Server, sa.Bind, sa.Port)
+
+	poll()
+	receive()
+}
+
+func startJetStreamServer() error {
+	sa := cfg.Standalone
+
+	opts := &natsd.Options{
+		ServerName: "prometheus_streams",
+		Host:       sa.Bind,
+		Port:       sa.Port,
+		JetStream:  true,
+		StoreDir:   sa.StoreDir,
+		NoSigs:     true,
+	}
+
+	srv, err := natsd.NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(10 * time.Second) {
+		srv.Shutdown()
+		return fmt.Errorf("server did not become ready")
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		srv.Shutdown()
+	}()
+
+	return nil
+}
+
+func startStreamingServer() error {
+	sa := cfg.Standalone
+
+	sopts := stand.GetDefaultOptions()
+	sopts.ID = sa.ClusterID
+
+	if sa.StoreDir != "" {
+		sopts.StoreType = stores.TypeFile
+		sopts.FilestoreDir = sa.StoreDir
+	}
+
+	nopts := stand.DefaultNatsServerOptions
+	nopts.Host = sa.Bind
+	nopts.Port = sa.Port
+	nopts.NoSigs = true
+
+	srv, err := stand.RunServerWithOpts(sopts, &nopts)
+	if err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		srv.Shutdown()
+	}()
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/sirupsen/logrus"
+)
+
+// freePort finds a port the embedded server can listen on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not find a free port: %s", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestStandaloneDeliversScrapes(t *testing.T) {
+	for _, server := range []string{"jetstream", "streaming"} {
+		t.Run(server, func(t *testing.T) {
+			testStandalone(t, server)
+		})
+	}
+}
+
+// testStandalone runs the standalone command against an embedded server and expects
+// a scrape of the target to be pushed to the Push Gateway
+func testStandalone(t *testing.T, server string) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+
+	pushes := make(chan string, 10)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes <- fmt.Sprintf("%s %s", r.URL.Path, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+
+	err := ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+scrape_interval: 1m
+identity: standalone.example.net
+jobs:
+  web:
+    targets:
+      - name: web1
+        url: %s
+push_gateway:
+  url: %s
+standalone:
+  server: %s
+  port: %d
+  store_dir: %s
+`, target.URL, gateway.URL, server, freePort(t), filepath.Join(dir, "store"))), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+
+	cfg, err = config.NewConfig(file)
+	if err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	log = logrus.NewEntry(logger)
+	cfg.Logger = log
+
+	wg = &sync.WaitGroup{}
+	ctx, cancel = context.WithCancel(context.Background())
+
+	defer func() {
+		cancel()
+
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			t.Errorf("standalone mode did not shut down")
+		}
+	}()
+
+	standalone()
+
+	select {
+	case p := <-pushes:
+		if p != "/metrics/job/web/instance/web1 up 1\n" {
+			t.Fatalf("unexpected push %q", p)
+		}
+
+	case <-time.After(20 * time.Second):
+		t.Fatalf("the scrape did not reach the Push Gateway")
+	}
+}
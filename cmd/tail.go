@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/choria-io/prometheus-streams/encryption"
+	"github.com/choria-io/prometheus-streams/scrape"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func tail() {
+	scfg := cfg.ReceiverStream
+	if tailPoller {
+		scfg = cfg.PollerStream
+	}
+
+	if scfg == nil {
+		kingpin.Fatalf("No stream configured to tail")
+	}
+
+	tcfg := *scfg
+	tcfg.ClientID = ""
+
+	subjects := tcfg.Subjects()
+	if tailTopic != "" {
+		subjects = []string{tailTopic}
+	}
+
+	conn, err := connection.New(ctx, &tcfg, cfg.Log("connector"), func(reason error) {
+		log.Errorf("Stream connection lost: %s", reason)
+		cancel()
+	})
+	if err != nil {
+		kingpin.Fatalf("Could not connect to the Stream: %s", err)
+	}
+	defer conn.Close()
+
+	jobs := make(map[string]bool)
+	for _, j := range tailJobs {
+		jobs[j] = true
+	}
+
+	publishers := make(map[string]bool)
+	for _, p := range tailPublishers {
+		publishers[p] = true
+	}
+
+	var keyring *encryption.Keyring
+	if cfg.Encryption != nil {
+		keyring, err = encryption.New(cfg.Encryption)
+		if err != nil {
+			kingpin.Fatalf("Could not set up decryption: %s", err)
+		}
+	}
+
+	opts := connection.SubscribeOptions{}
+	if tailSince > 0 {
+		opts.StartTime = time.Now().Add(-tailSince)
+	}
+
+	handler := func(msg *connection.Message) {
+		s := scrape.Scrape{}
+
+		err := json.Unmarshal(msg.Data, &s)
+		if err != nil {
+			fmt.Printf("[%d] could not decode %d bytes: %s\n", msg.Sequence, len(msg.Data), err)
+			return
+		}
+
+		if len(jobs) > 0 && !jobs[s.Job] {
+			return
+		}
+
+		if len(publishers) > 0 && !publishers[s.Publisher] {
+			return
+		}
+
+		if s.Encrypted() {
+			if keyring == nil {
+				fmt.Printf("[%d] publisher=%s job=%s instance=%s encrypted with key %s\n", msg.Sequence, s.Publisher, s.Job, s.Instance, s.KeyID)
+				return
+			}
+
+			err = s.Decrypt(keyring)
+			if err != nil {
+				fmt.Printf("[%d] %s %s/%s could not decrypt scrape: %s\n", msg.Sequence, s.Publisher, s.Job, s.Instance, err)
+				return
+			}
+		}
+
+		body, err := s.Body()
+		if err != nil {
+			fmt.Printf("[%d] %s %s/%s could not decompress scrape: %s\n", msg.Sequence, s.Publisher, s.Job, s.Instance, err)
+			return
+		}
+
+		age := time.Since(time.Unix(s.Timestamp, 0)).Round(time.Second)
+
+		fmt.Printf("[%d] publisher=%s job=%s instance=%s age=%s compressed=%d size=%d\n", msg.Sequence, s.Publisher, s.Job, s.Instance, age, len(s.Scrape), len(body))
+
+		if tailDump {
+			fmt.Println(string(body))
+		}
+	}
+
+	for _, subject := range subjects {
+		sub, err := conn.Subscribe(subject, opts, handler)
+		if err != nil {
+			kingpin.Fatalf("Could not subscribe to %s: %s", subject, err)
+		}
+		defer sub.Unsubscribe()
+
+		log.Infof("Tailing %s", subject)
+	}
+
+	<-ctx.Done()
+}
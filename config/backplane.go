@@ -4,12 +4,38 @@ import (
 	"github.com/choria-io/prometheus-streams/build"
 )
 
-// FactData implements backplane.InfoSource
+// FactData implements backplane.InfoSource, stream secrets are redacted
 func (c *Config) FactData() interface{} {
-	return c
+	facts := *c
+	facts.PollerStreams = StreamConfigs{}
+	for _, s := range c.PollerStreams {
+		facts.PollerStreams = append(facts.PollerStreams, s.redacted())
+	}
+
+	facts.ReceiverStream = c.ReceiverStream.redacted()
+
+	return &facts
 }
 
 // Version implements backplane.InfoSource
 func (c *Config) Version() string {
 	return build.Version
 }
+
+func (s *StreamConfig) redacted() *StreamConfig {
+	if s == nil {
+		return nil
+	}
+
+	r := *s
+
+	if r.Token != "" {
+		r.Token = "[redacted]"
+	}
+
+	if r.Password != "" {
+		r.Password = "[redacted]"
+	}
+
+	return &r
+}
@@ -1,14 +1,21 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/choria-io/go-backplane/backplane"
+	"github.com/choria-io/prometheus-streams/backoff"
 	"github.com/ghodss/yaml"
 	"github.com/sirupsen/logrus"
 )
@@ -25,11 +32,23 @@ type Config struct {
 	MaxAge      int64  `json:"max_age"`
 	MonitorPort int64  `json:"monitor_port"`
 
-	Jobs           map[string]*Job
-	PollerStream   *StreamConfig                    `json:"poller_stream"`
-	ReceiverStream *StreamConfig                    `json:"receiver_stream"`
-	PushGateway    *PushGatewayConfig               `json:"push_gateway"`
-	Management     *backplane.StandardConfiguration `json:"management"`
+	SignScrapes   bool `json:"sign_scrapes"`
+	RequireSigned bool `json:"require_signed"`
+
+	Jobs             map[string]*Job
+	PollerStreams    StreamConfigs       `json:"poller_stream"`
+	PollerStreamMode string              `json:"poller_stream_mode"`
+	ReceiverStream   *StreamConfig       `json:"receiver_stream"`
+	PushGateway      *PushGatewayConfig  `json:"push_gateway"`
+	DeadLetter       *DeadLetterConfig   `json:"dead_letter"`
+	ACL              *ACLConfig          `json:"acl"`
+	Encryption       *EncryptionConfig   `json:"encryption"`
+	PushEndpoint     *PushEndpointConfig `json:"push_endpoint"`
+	Management       *ManagementConfig   `json:"management"`
+	Standalone       *StandaloneConfig   `json:"standalone"`
+
+	// PollerStream is the first of the PollerStreams
+	PollerStream *StreamConfig `json:"-"`
 
 	Logger *logrus.Entry `json:"-"`
 	TLS    *TLSConf      `json:"tls"`
@@ -39,6 +58,7 @@ type Config struct {
 
 // Job holds a specific job with many targets
 type Job struct {
+	Type    string    `json:"type"`
 	Targets []*Target `json:"targets"`
 }
 
@@ -46,21 +66,227 @@ type Job struct {
 type Target struct {
 	Name string `json:"name"`
 	URL  string `json:"url"`
+
+	// textfile targets
+	Directory string `json:"directory"`
+	PerFile   bool   `json:"per_file"`
+	Stale     string `json:"stale"`
+
+	// exec targets, the command and its arguments
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout"`
+
+	// probe targets
+	Probe       string `json:"probe"`
+	Address     string `json:"address"`
+	ValidStatus []int  `json:"valid_status"`
+	Regex       string `json:"regex"`
+	RecordType  string `json:"record_type"`
+	Resolver    string `json:"resolver"`
+
+	StaleDuration   time.Duration  `json:"-"`
+	TimeoutDuration time.Duration  `json:"-"`
+	RegexPattern    *regexp.Regexp `json:"-"`
+}
+
+// Source is a description of where the target gets its data from
+func (t *Target) Source() string {
+	switch {
+	case t.Directory != "":
+		return t.Directory
+	case len(t.Command) > 0:
+		return strings.Join(t.Command, " ")
+	case t.Address != "":
+		return fmt.Sprintf("%s://%s", t.Probe, t.Address)
+	default:
+		return t.URL
+	}
+}
+
+// StreamConfigs is one or more streams, it can be configured as a single stream or a list
+type StreamConfigs []*StreamConfig
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *StreamConfigs) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+
+	case bytes.HasPrefix(data, []byte("[")):
+		streams := []*StreamConfig{}
+		err := json.Unmarshal(data, &streams)
+		if err != nil {
+			return err
+		}
+
+		*s = streams
+
+	default:
+		stream := &StreamConfig{}
+		err := json.Unmarshal(data, stream)
+		if err != nil {
+			return err
+		}
+
+		*s = StreamConfigs{stream}
+	}
+
+	return nil
+}
+
+// NATSAuth holds the authentication options of a NATS connection
+type NATSAuth struct {
+	Credentials  string `json:"credentials"`
+	NKeySeed     string `json:"nkey_seed"`
+	Token        string `json:"token"`
+	TokenFile    string `json:"token_file"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+}
+
+// ManagementConfig configures the Choria Backplane, it connects to the Choria
+// brokers using TLS only so NATS authentication options are rejected rather
+// than silently ignored
+type ManagementConfig struct {
+	backplane.StandardConfiguration
+	NATSAuth
 }
 
 // StreamConfig is the target to publish data to
 type StreamConfig struct {
-	ClientID  string   `json:"client_id"`
-	ClusterID string   `json:"cluster_id"`
-	URLs      string   `json:"urls"`
-	Topic     string   `json:"topic"`
-	TLS       *TLSConf `json:"tls"`
+	Name       string           `json:"name"`
+	ClientID   string           `json:"client_id"`
+	ClusterID  string           `json:"cluster_id"`
+	URLs       string           `json:"urls"`
+	Topic      string           `json:"topic"`
+	Topics     []string         `json:"topics"`
+	QueueGroup string           `json:"queue_group"`
+	StartAt    string           `json:"start_at"`
+	TLS        *TLSConf         `json:"tls"`
+	Transport  string           `json:"transport"`
+	JetStream  *JetStreamConfig `json:"jetstream"`
+	Directory  string           `json:"directory"`
+	Retention  string           `json:"retention"`
+
+	PingInterval       string `json:"ping_interval"`
+	MaxPingsOut        int    `json:"max_pings_out"`
+	ReconnectWait      string `json:"reconnect_wait"`
+	ReconnectJitter    string `json:"reconnect_jitter"`
+	ConnectTimeout     string `json:"connect_timeout"`
+	PubAckWait         string `json:"pub_ack_wait"`
+	MaxPubAcksInflight int    `json:"max_pub_acks_inflight"`
+	MaxInflight        int    `json:"max_inflight"`
+	AckWait            string `json:"ack_wait"`
+	Backoff            string `json:"backoff"`
+
+	PublishMaxInflight int    `json:"publish_max_inflight"`
+	PublishAckTimeout  string `json:"publish_ack_timeout"`
+	PublishRetries     int    `json:"publish_retries"`
+
+	NATSAuth
+
+	StartSequence             uint64        `json:"-"`
+	StartDelta                time.Duration `json:"-"`
+	RetentionDuration         time.Duration `json:"-"`
+	PublishAckTimeoutDuration time.Duration `json:"-"`
+	PingIntervalDuration      time.Duration `json:"-"`
+	ReconnectWaitDuration     time.Duration `json:"-"`
+	ReconnectJitterDuration   time.Duration `json:"-"`
+	ConnectTimeoutDuration    time.Duration `json:"-"`
+	PubAckWaitDuration        time.Duration `json:"-"`
+	AckWaitDuration           time.Duration `json:"-"`
+
+	BackoffPolicy backoff.BackoffPolicy `json:"-"`
+}
+
+// JetStreamConfig configures the JetStream transport
+type JetStreamConfig struct {
+	Stream        string   `json:"stream"`
+	Create        bool     `json:"create"`
+	Update        bool     `json:"update"`
+	Subjects      []string `json:"subjects"`
+	MaxAge        string   `json:"max_age"`
+	Replicas      int      `json:"replicas"`
+	Storage       string   `json:"storage"`
+	Consumer      string   `json:"consumer"`
+	AckWait       string   `json:"ack_wait"`
+	MaxAckPending int      `json:"max_ack_pending"`
+	PullBatch     int      `json:"pull_batch"`
+
+	MaxAgeDuration  time.Duration `json:"-"`
+	AckWaitDuration time.Duration `json:"-"`
 }
 
 // PushGatewayConfig where the receiver will publish metrics to
 type PushGatewayConfig struct {
-	URL            string `json:"url"`
-	PublisherLabel bool   `json:"publisher_label"`
+	URL            string          `json:"url"`
+	PublisherLabel bool            `json:"publisher_label"`
+	Workers        int             `json:"workers"`
+	Timeout        string          `json:"timeout"`
+	Outputs        []*OutputConfig `json:"outputs"`
+
+	TimeoutDuration time.Duration `json:"-"`
+}
+
+// OutputConfig is a named Push Gateway that every scrape will be pushed to
+type OutputConfig struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Retries int    `json:"retries"`
+}
+
+// PushEndpointConfig is a Push Gateway compatible listener on the poller
+type PushEndpointConfig struct {
+	Bind    string `json:"bind"`
+	Port    int    `json:"port"`
+	MaxSize int64  `json:"max_size"`
+
+	RemoteWrite         bool   `json:"remote_write"`
+	RemoteWritePath     string `json:"remote_write_path"`
+	RemoteWriteJob      string `json:"remote_write_job"`
+	RemoteWriteInterval string `json:"remote_write_interval"`
+
+	RemoteWriteIntervalDuration time.Duration `json:"-"`
+}
+
+// DeadLetterConfig is where the receiver stores scrapes it could not deliver
+type DeadLetterConfig struct {
+	Topic         string `json:"topic"`
+	Directory     string `json:"directory"`
+	MaxFiles      int    `json:"max_files"`
+	ReinjectState string `json:"reinject_state"`
+}
+
+// ACLConfig restricts what the receiver will push to the Push Gateway
+type ACLConfig struct {
+	Allow []*ACLRule `json:"allow"`
+	Deny  []*ACLRule `json:"deny"`
+}
+
+// ACLRule matches publishers, jobs and instances using globs or /regular expressions/,
+// empty values match anything
+type ACLRule struct {
+	Publisher string `json:"publisher"`
+	Job       string `json:"job"`
+	Instance  string `json:"instance"`
+}
+
+// EncryptionConfig configures encryption of scrapes between poller and receiver
+type EncryptionConfig struct {
+	Keys     []*EncryptionKey `json:"keys"`
+	Required bool             `json:"required"`
+}
+
+// EncryptionKey is a shared key or RSA key pair, pollers need a shared or public key
+// while receivers need a shared or private key
+type EncryptionKey struct {
+	ID             string `json:"id"`
+	SharedKeyFile  string `json:"shared_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+	PrivateKeyFile string `json:"private_key_file"`
 }
 
 // NewConfig parses a config file into a Config
@@ -120,13 +346,16 @@ func (cfg *Config) prepare() error {
 		}
 	}
 
-	if cfg.TLS != nil {
-		if cfg.PollerStream.TLS == nil {
-			cfg.PollerStream.TLS = cfg.TLS
-		}
+	err = cfg.preparePollerStreams()
+	if err != nil {
+		return err
+	}
 
-		if cfg.ReceiverStream.TLS == nil {
-			cfg.ReceiverStream.TLS = cfg.TLS
+	if cfg.TLS != nil {
+		for _, s := range append([]*StreamConfig{cfg.ReceiverStream}, cfg.PollerStreams...) {
+			if s != nil && s.TLS == nil {
+				s.TLS = cfg.TLS
+			}
 		}
 
 		if cfg.Management != nil && cfg.Management.TLSConf == nil {
@@ -142,18 +371,732 @@ func (cfg *Config) prepare() error {
 		}
 	}
 
-	for _, job := range cfg.Jobs {
-		for _, target := range job.Targets {
+	if cfg.Management != nil && cfg.Management.configured() {
+		return fmt.Errorf("management does not support credentials, nkey_seed, token or username authentication, the Choria Backplane connects using tls only")
+	}
+
+	if cfg.SignScrapes && (cfg.PollerStream == nil || cfg.PollerStream.TLS == nil) {
+		return fmt.Errorf("sign_scrapes requires TLS to be configured for the poller_stream")
+	}
+
+	if cfg.RequireSigned && (cfg.ReceiverStream == nil || cfg.ReceiverStream.TLS == nil) {
+		return fmt.Errorf("require_signed requires TLS to be configured for the receiver_stream")
+	}
+
+	if cfg.Encryption != nil {
+		if len(cfg.Encryption.Keys) == 0 {
+			return fmt.Errorf("encryption requires at least one key")
+		}
+
+		for _, k := range cfg.Encryption.Keys {
+			if k.ID == "" {
+				return fmt.Errorf("encryption keys require an id")
+			}
+
+			if k.SharedKeyFile == "" && k.PublicKeyFile == "" && k.PrivateKeyFile == "" {
+				return fmt.Errorf("encryption key %s requires a shared_key_file, public_key_file or private_key_file", k.ID)
+			}
+		}
+	}
+
+	if cfg.ReceiverStream != nil {
+		err = cfg.ReceiverStream.parseStartAt()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range append([]*StreamConfig{cfg.ReceiverStream}, cfg.PollerStreams...) {
+		if s == nil {
+			continue
+		}
+
+		err = s.prepareTopics()
+		if err != nil {
+			return err
+		}
+
+		err = s.prepareTransport()
+		if err != nil {
+			return err
+		}
+
+		err = s.prepareAuth()
+		if err != nil {
+			return err
+		}
+
+		err = s.prepareTuning()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ReceiverStream != nil && cfg.ReceiverStream.Transport != "jetstream" {
+		for _, subject := range cfg.ReceiverStream.Subjects() {
+			if strings.ContainsAny(subject, "*>") {
+				return fmt.Errorf("the %s transport does not support subscribing to wildcard subject %s", cfg.ReceiverStream.Transport, subject)
+			}
+		}
+	}
+
+	if cfg.PushGateway != nil {
+		if cfg.PushGateway.Workers <= 0 {
+			cfg.PushGateway.Workers = 1
+		}
+
+		if cfg.PushGateway.Timeout == "" {
+			cfg.PushGateway.Timeout = "10s"
+		}
+
+		cfg.PushGateway.TimeoutDuration, err = time.ParseDuration(cfg.PushGateway.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid push_gateway timeout: %s", err)
+		}
+
+		if cfg.PushGateway.URL != "" {
+			cfg.PushGateway.Outputs = append([]*OutputConfig{{Name: "default", URL: cfg.PushGateway.URL}}, cfg.PushGateway.Outputs...)
+		}
+
+		if len(cfg.PushGateway.Outputs) == 0 {
+			return fmt.Errorf("push_gateway requires a url or at least one output")
+		}
+
+		seen := make(map[string]bool)
+		for _, o := range cfg.PushGateway.Outputs {
+			if o.Name == "" || o.URL == "" {
+				return fmt.Errorf("push_gateway outputs require a name and url")
+			}
+
+			if seen[o.Name] {
+				return fmt.Errorf("duplicate push_gateway output %s", o.Name)
+			}
+
+			seen[o.Name] = true
+		}
+	}
+
+	if cfg.PushEndpoint != nil {
+		if cfg.PushEndpoint.Port <= 0 {
+			return fmt.Errorf("push_endpoint requires a port")
+		}
+
+		if cfg.PushEndpoint.MaxSize == 0 {
+			cfg.PushEndpoint.MaxSize = 10 * 1024 * 1024
+		}
+
+		if cfg.PushEndpoint.RemoteWritePath == "" {
+			cfg.PushEndpoint.RemoteWritePath = "/api/v1/write"
+		}
+
+		if cfg.PushEndpoint.RemoteWriteJob == "" {
+			cfg.PushEndpoint.RemoteWriteJob = "remote_write"
+		}
+
+		if cfg.PushEndpoint.RemoteWriteInterval == "" {
+			cfg.PushEndpoint.RemoteWriteInterval = cfg.Interval
+		}
+
+		cfg.PushEndpoint.RemoteWriteIntervalDuration, err = time.ParseDuration(cfg.PushEndpoint.RemoteWriteInterval)
+		if err != nil || cfg.PushEndpoint.RemoteWriteIntervalDuration <= 0 {
+			return fmt.Errorf("invalid push_endpoint remote_write_interval '%s'", cfg.PushEndpoint.RemoteWriteInterval)
+		}
+	}
+
+	if cfg.DeadLetter != nil {
+		if cfg.DeadLetter.Topic == "" && cfg.DeadLetter.Directory == "" {
+			return fmt.Errorf("dead_letter requires a topic or a directory")
+		}
+
+		if cfg.DeadLetter.MaxFiles == 0 {
+			cfg.DeadLetter.MaxFiles = 1000
+		}
+
+		// letters are published on the receiver connection so a stream it manages has to hold them
+		rs := cfg.ReceiverStream
+		if cfg.DeadLetter.Topic != "" && rs != nil && rs.Transport == "jetstream" && (rs.JetStream.Create || rs.JetStream.Update) {
+			if !subjectsCover(rs.JetStream.Subjects, cfg.DeadLetter.Topic) {
+				return fmt.Errorf("dead_letter topic %s is not covered by the receiver_stream jetstream subjects %s", cfg.DeadLetter.Topic, strings.Join(rs.JetStream.Subjects, ", "))
+			}
+		}
+	}
+
+	for name, job := range cfg.Jobs {
+		switch job.Type {
+		case "", "http":
+			job.Type = "http"
+			err = job.prepareHTTP()
+		case "textfile":
+			err = job.prepareTextfile(cfg.Hostname)
+		case "exec":
+			err = job.prepareExec()
+		case "probe":
+			err = job.prepareProbe()
+		default:
+			err = fmt.Errorf("unknown type %s", job.Type)
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid job %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (job *Job) prepareHTTP() error {
+	for _, target := range job.Targets {
+		if socket, _, ok := target.UnixSocket(); ok {
+			if socket == "" {
+				return fmt.Errorf("invalid unix socket url %s", target.URL)
+			}
+
 			if target.Name == "" {
-				u, err := url.Parse(target.URL)
+				target.Name = filepath.Base(socket)
+			}
+
+			continue
+		}
+
+		if target.Name == "" {
+			u, err := url.Parse(target.URL)
+			if err != nil {
+				return err
+			}
+
+			target.Name = fmt.Sprintf("%s:%s", u.Hostname(), u.Port())
+		}
+	}
+
+	return nil
+}
+
+// UnixSocket parses urls like unix:///run/app.sock:/metrics into the socket
+// and the HTTP path, the path defaults to /metrics
+func (t *Target) UnixSocket() (socket string, path string, ok bool) {
+	if !strings.HasPrefix(t.URL, "unix://") {
+		return "", "", false
+	}
+
+	socket = strings.TrimPrefix(t.URL, "unix://")
+	path = "/metrics"
+
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, path = socket[:i], socket[i+1:]
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return socket, path, true
+}
+
+// exec targets default to the name of the command being run
+func (job *Job) prepareExec() error {
+	var err error
+
+	for _, target := range job.Targets {
+		if len(target.Command) == 0 || target.Command[0] == "" {
+			return fmt.Errorf("exec targets require a command")
+		}
+
+		if target.Name == "" {
+			target.Name = filepath.Base(target.Command[0])
+		}
+
+		if target.Timeout != "" {
+			target.TimeoutDuration, err = time.ParseDuration(target.Timeout)
+			if err != nil {
+				return fmt.Errorf("invalid timeout for %s: %s", target.Source(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// probe targets default to the name of the probe and what is being probed
+func (job *Job) prepareProbe() error {
+	var err error
+
+	for _, target := range job.Targets {
+		switch target.Probe {
+		case "http":
+			u, err := url.Parse(target.URL)
+			if err != nil || u.Host == "" {
+				return fmt.Errorf("http probes require a valid url")
+			}
+
+			if target.Name == "" {
+				target.Name = fmt.Sprintf("http_%s", u.Host)
+			}
+
+			if len(target.ValidStatus) == 0 {
+				target.ValidStatus = []int{200}
+			}
+
+			if target.Regex != "" {
+				target.RegexPattern, err = regexp.Compile(target.Regex)
 				if err != nil {
-					return err
+					return fmt.Errorf("invalid regex for %s: %s", target.URL, err)
+				}
+			}
+
+		case "tcp", "tls":
+			_, _, err := net.SplitHostPort(target.Address)
+			if err != nil {
+				return fmt.Errorf("%s probes require an address in host:port format: %s", target.Probe, err)
+			}
+
+		case "dns":
+			if target.Address == "" {
+				return fmt.Errorf("dns probes require an address to resolve")
+			}
+
+			switch target.RecordType {
+			case "":
+				target.RecordType = "A"
+			case "A", "AAAA", "CNAME", "MX", "NS", "TXT":
+			default:
+				return fmt.Errorf("unsupported dns record type %s", target.RecordType)
+			}
+
+		default:
+			return fmt.Errorf("unknown probe '%s', expected http, tcp, tls or dns", target.Probe)
+		}
+
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("%s_%s", target.Probe, target.Address)
+		}
+
+		if target.Timeout != "" {
+			target.TimeoutDuration, err = time.ParseDuration(target.Timeout)
+			if err != nil {
+				return fmt.Errorf("invalid timeout for %s: %s", target.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// textfile targets default to the name of the poller when all files are merged
+func (job *Job) prepareTextfile(hostname string) error {
+	var err error
+
+	for _, target := range job.Targets {
+		if target.Directory == "" {
+			return fmt.Errorf("textfile targets require a directory")
+		}
+
+		if target.Name == "" {
+			target.Name = hostname
+		}
+
+		if target.Stale != "" {
+			target.StaleDuration, err = time.ParseDuration(target.Stale)
+			if err != nil {
+				return fmt.Errorf("invalid stale setting for %s: %s", target.Directory, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validates the transport and sets JetStream defaults
+func (s *StreamConfig) prepareTransport() error {
+	switch s.Transport {
+	case "", "stan":
+		s.Transport = "stan"
+		return nil
+
+	case "jetstream":
+		return s.prepareJetStream()
+
+	case "memory", "directory":
+		return s.prepareLocal()
+
+	default:
+		return fmt.Errorf("unknown transport '%s', expected stan, jetstream, memory or directory", s.Transport)
+	}
+}
+
+// TopicPlaceholders are the values that can be used in a topic template
+var TopicPlaceholders = []string{"{{publisher}}", "{{job}}", "{{instance}}"}
+
+// checks that template placeholders in the topic are known and make up whole subject tokens
+func (s *StreamConfig) prepareTopics() error {
+	for _, token := range strings.Split(s.Topic, ".") {
+		if !strings.Contains(token, "{{") {
+			continue
+		}
+
+		known := false
+		for _, p := range TopicPlaceholders {
+			if token == p {
+				known = true
+			}
+		}
+
+		if !known {
+			return fmt.Errorf("invalid topic %s: %s is not a supported placeholder or not a whole token", s.Topic, token)
+		}
+	}
+
+	return nil
+}
+
+// Subjects are the subjects to subscribe to, the topics when set else the topic with
+// any template placeholders replaced by wildcards
+func (s *StreamConfig) Subjects() []string {
+	if len(s.Topics) > 0 {
+		return s.Topics
+	}
+
+	subject := s.Topic
+	for _, p := range TopicPlaceholders {
+		subject = strings.Replace(subject, p, "*", -1)
+	}
+
+	return []string{subject}
+}
+
+// sets defaults for asynchronous publishing, at most publish_max_inflight messages
+// wait for acknowledgement for up to publish_ack_timeout and failed publishes are
+// tried publish_retries more times, -1 disables retries
+func (s *StreamConfig) preparePublish() error {
+	var err error
+
+	if s.PublishMaxInflight <= 0 {
+		s.PublishMaxInflight = 100
+	}
+
+	if s.PublishAckTimeout == "" {
+		s.PublishAckTimeout = "30s"
+	}
+
+	s.PublishAckTimeoutDuration, err = time.ParseDuration(s.PublishAckTimeout)
+	if err != nil || s.PublishAckTimeoutDuration <= 0 {
+		return fmt.Errorf("invalid publish_ack_timeout '%s' for poller_stream %s", s.PublishAckTimeout, s.Name)
+	}
+
+	switch {
+	case s.PublishRetries == 0:
+		s.PublishRetries = 3
+	case s.PublishRetries == -1:
+		s.PublishRetries = 0
+	case s.PublishRetries < -1:
+		return fmt.Errorf("invalid publish_retries %d for poller_stream %s", s.PublishRetries, s.Name)
+	}
+
+	return nil
+}
+
+// names the poller streams and validates the publish mode, all publishes every scrape
+// to every stream while failover publishes to the first stream that is connected
+func (cfg *Config) preparePollerStreams() error {
+	switch cfg.PollerStreamMode {
+	case "":
+		cfg.PollerStreamMode = "all"
+	case "all", "failover":
+	default:
+		return fmt.Errorf("invalid poller_stream_mode '%s', expected all or failover", cfg.PollerStreamMode)
+	}
+
+	if len(cfg.PollerStreams) == 0 {
+		return nil
+	}
+
+	names := make(map[string]bool)
+
+	for i, s := range cfg.PollerStreams {
+		if s == nil {
+			return fmt.Errorf("poller_stream %d is empty", i)
+		}
+
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("stream_%d", i)
+		}
+
+		if names[s.Name] {
+			return fmt.Errorf("duplicate poller_stream name %s", s.Name)
+		}
+
+		names[s.Name] = true
+
+		err := s.preparePublish()
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.PollerStream = cfg.PollerStreams[0]
+
+	return nil
+}
+
+// parses the connection tuning options, durations and counts that are not set
+// leave the client library defaults in place
+func (s *StreamConfig) prepareTuning() error {
+	var err error
+
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"ping_interval", s.PingInterval, &s.PingIntervalDuration},
+		{"reconnect_wait", s.ReconnectWait, &s.ReconnectWaitDuration},
+		{"reconnect_jitter", s.ReconnectJitter, &s.ReconnectJitterDuration},
+		{"connect_timeout", s.ConnectTimeout, &s.ConnectTimeoutDuration},
+		{"pub_ack_wait", s.PubAckWait, &s.PubAckWaitDuration},
+		{"ack_wait", s.AckWait, &s.AckWaitDuration},
+	}
+
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+
+		*d.dest, err = time.ParseDuration(d.value)
+		if err != nil || *d.dest <= 0 {
+			return fmt.Errorf("invalid %s '%s'", d.name, d.value)
+		}
+	}
+
+	// the NATS Streaming client library has no reconnect jitter setting
+	if s.ReconnectJitterDuration > 0 && s.Transport != "jetstream" {
+		return fmt.Errorf("reconnect_jitter is only supported by the jetstream transport")
+	}
+
+	if s.MaxPingsOut < 0 || s.MaxPubAcksInflight < 0 || s.MaxInflight < 0 {
+		return fmt.Errorf("max_pings_out, max_pub_acks_inflight and max_inflight can not be negative")
+	}
+
+	if s.MaxInflight == 0 {
+		s.MaxInflight = 10
+	}
+
+	if s.Backoff == "" {
+		s.Backoff = "five_sec"
+	}
+
+	policy, ok := backoff.Policies[s.Backoff]
+	if !ok {
+		return fmt.Errorf("unknown backoff policy '%s', expected five_sec, twenty_sec or one_minute", s.Backoff)
+	}
+
+	s.BackoffPolicy = policy
+
+	return nil
+}
+
+// validates the NATS authentication options, only one method can be used and
+// the token and password are read from their files when set
+func (s *StreamConfig) prepareAuth() error {
+	err := s.NATSAuth.prepare()
+	if err != nil {
+		return err
+	}
+
+	if s.configured() && (s.Transport == "memory" || s.Transport == "directory") {
+		return fmt.Errorf("authentication is not supported by the %s transport", s.Transport)
+	}
+
+	return nil
+}
+
+// configured checks if any authentication method is set
+func (a *NATSAuth) configured() bool {
+	return a.Credentials != "" || a.NKeySeed != "" || a.Token != "" || a.TokenFile != "" || a.Username != "" || a.Password != "" || a.PasswordFile != ""
+}
+
+func (a *NATSAuth) prepare() error {
+	if a.TokenFile != "" {
+		token, err := readSecret(a.TokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read token_file: %s", err)
+		}
+
+		a.Token = token
+	}
+
+	if a.PasswordFile != "" {
+		password, err := readSecret(a.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("could not read password_file: %s", err)
+		}
+
+		a.Password = password
+	}
+
+	methods := 0
+	for _, m := range []string{a.Credentials, a.NKeySeed, a.Token, a.Username} {
+		if m != "" {
+			methods++
+		}
+	}
+
+	if methods > 1 {
+		return fmt.Errorf("only one of credentials, nkey_seed, token or username can be set")
+	}
+
+	if a.Password != "" && a.Username == "" {
+		return fmt.Errorf("a password requires a username")
+	}
+
+	for _, f := range []string{a.Credentials, a.NKeySeed} {
+		if f == "" {
+			continue
+		}
+
+		_, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("cannot access %s: %s", f, err)
+		}
+	}
+
+	return nil
+}
+
+func readSecret(file string) (string, error) {
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// validates the memory and directory transports, both keep messages for the
+// retention period which defaults to an hour
+func (s *StreamConfig) prepareLocal() error {
+	var err error
+
+	if s.Transport == "directory" && s.Directory == "" {
+		return fmt.Errorf("the directory transport requires a directory")
+	}
+
+	if s.Retention == "" {
+		s.Retention = "1h"
+	}
+
+	s.RetentionDuration, err = time.ParseDuration(s.Retention)
+	if err != nil || s.RetentionDuration <= 0 {
+		return fmt.Errorf("invalid stream retention '%s'", s.Retention)
+	}
+
+	return nil
+}
+
+func (s *StreamConfig) prepareJetStream() error {
+	if s.JetStream == nil {
+		s.JetStream = &JetStreamConfig{}
+	}
+
+	js := s.JetStream
+	var err error
+
+	if (js.Create || js.Update) && js.Stream == "" {
+		return fmt.Errorf("jetstream requires a stream name to create or update the stream")
+	}
+
+	if len(js.Subjects) == 0 {
+		js.Subjects = s.Subjects()
+	}
+
+	switch js.Storage {
+	case "":
+		js.Storage = "file"
+	case "file", "memory":
+	default:
+		return fmt.Errorf("invalid jetstream storage '%s', expected file or memory", js.Storage)
+	}
+
+	switch js.Consumer {
+	case "":
+		js.Consumer = "push"
+	case "push", "pull":
+	default:
+		return fmt.Errorf("invalid jetstream consumer '%s', expected push or pull", js.Consumer)
+	}
+
+	if js.MaxAge != "" {
+		js.MaxAgeDuration, err = time.ParseDuration(js.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid jetstream max_age: %s", err)
+		}
+	}
+
+	if js.AckWait == "" {
+		js.AckWait = "30s"
+	}
+
+	js.AckWaitDuration, err = time.ParseDuration(js.AckWait)
+	if err != nil {
+		return fmt.Errorf("invalid jetstream ack_wait: %s", err)
+	}
+
+	if js.PullBatch <= 0 {
+		js.PullBatch = 10
+	}
+
+	return nil
+}
+
+// parses start_at into either a sequence or a time delta, first, last and new
+// are left as is
+// subjectsCover checks if any of subjects, which may hold wildcards, matches subject
+func subjectsCover(subjects []string, subject string) bool {
+	tokens := strings.Split(subject, ".")
+
+	for _, s := range subjects {
+		pattern := strings.Split(s, ".")
+
+		for i, p := range pattern {
+			if p == ">" {
+				if len(tokens) > i {
+					return true
 				}
 
-				target.Name = fmt.Sprintf("%s:%s", u.Hostname(), u.Port())
+				break
+			}
+
+			if i >= len(tokens) || (p != "*" && p != tokens[i]) {
+				break
+			}
+
+			if i == len(pattern)-1 && len(tokens) == len(pattern) {
+				return true
 			}
 		}
 	}
 
+	return false
+}
+
+func (s *StreamConfig) parseStartAt() error {
+	switch s.StartAt {
+	case "", "first":
+		s.StartAt = "first"
+		return nil
+
+	case "last", "new":
+		return nil
+	}
+
+	seq, err := strconv.ParseUint(s.StartAt, 10, 64)
+	if err == nil {
+		s.StartSequence = seq
+		return nil
+	}
+
+	s.StartDelta, err = time.ParseDuration(s.StartAt)
+	if err != nil || s.StartDelta <= 0 {
+		return fmt.Errorf("invalid start_at '%s', expected first, last, new, a sequence number or a duration", s.StartAt)
+	}
+
 	return nil
 }
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeadLetterTopicInStreamSubjects(t *testing.T) {
+	cases := []struct {
+		name      string
+		jetstream string
+		valid     bool
+	}{
+		{name: "default subjects", jetstream: "create: true", valid: false},
+		{name: "listed", jetstream: "create: true\n    subjects: [prometheus, prometheus.dead_letter]", valid: true},
+		{name: "star wildcard", jetstream: "create: true\n    subjects: [prometheus, prometheus.*]", valid: true},
+		{name: "tail wildcard", jetstream: "update: true\n    subjects: [\"prometheus.>\"]", valid: true},
+		{name: "other subjects", jetstream: "update: true\n    subjects: [prometheus, other.*]", valid: false},
+		{name: "unmanaged stream", jetstream: "create: false", valid: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+
+			err := ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  client_id: receiver
+  urls: nats://localhost:4222
+  topic: prometheus
+  transport: jetstream
+  jetstream:
+    stream: PROMETHEUS
+    %s
+push_gateway:
+  url: http://localhost:9091
+dead_letter:
+  topic: prometheus.dead_letter
+`, c.jetstream)), 0600)
+			if err != nil {
+				t.Fatalf("could not write config: %s", err)
+			}
+
+			_, err = NewConfig(file)
+
+			if c.valid && err != nil {
+				t.Fatalf("valid config was rejected: %s", err)
+			}
+
+			if !c.valid && err == nil {
+				t.Fatalf("invalid config was accepted")
+			}
+		})
+	}
+}
+
+func TestSubjectsCover(t *testing.T) {
+	cases := []struct {
+		subjects []string
+		subject  string
+		covered  bool
+	}{
+		{subjects: []string{"a.b"}, subject: "a.b", covered: true},
+		{subjects: []string{"a.b"}, subject: "a.b.c", covered: false},
+		{subjects: []string{"a.b.c"}, subject: "a.b", covered: false},
+		{subjects: []string{"a.*"}, subject: "a.b", covered: true},
+		{subjects: []string{"a.*"}, subject: "a.b.c", covered: false},
+		{subjects: []string{"a.>"}, subject: "a.b.c", covered: true},
+		{subjects: []string{"a.>"}, subject: "a", covered: false},
+		{subjects: []string{">"}, subject: "a", covered: true},
+		{subjects: []string{"x", "*.b"}, subject: "a.b", covered: true},
+	}
+
+	for _, c := range cases {
+		if subjectsCover(c.subjects, c.subject) != c.covered {
+			t.Errorf("expected %v covering %s to be %v", c.subjects, c.subject, c.covered)
+		}
+	}
+}
+
+func TestManagementRejectsNATSAuth(t *testing.T) {
+	cases := []struct {
+		name  string
+		auth  string
+		valid bool
+	}{
+		{name: "tls only", auth: "", valid: true},
+		{name: "token", auth: "token: s3cret", valid: false},
+		{name: "username", auth: "username: prom\n  password: s3cret", valid: false},
+		{name: "credentials", auth: "credentials: /etc/prometheus-streams/management.creds", valid: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+
+			err := ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  client_id: receiver
+  urls: nats://localhost:4222
+  topic: prometheus
+push_gateway:
+  url: http://localhost:9091
+management:
+  name: prometheus_streams
+  %s
+`, c.auth)), 0600)
+			if err != nil {
+				t.Fatalf("could not write config: %s", err)
+			}
+
+			cfg, err := NewConfig(file)
+
+			if c.valid && err != nil {
+				t.Fatalf("valid config was rejected: %s", err)
+			}
+
+			if !c.valid && err == nil {
+				t.Fatalf("management authentication %q was accepted", c.auth)
+			}
+
+			if c.valid && cfg.Management == nil {
+				t.Fatalf("management was not configured")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+)
+
+// StandaloneConfig configures the embedded Stream server used by the standalone command
+type StandaloneConfig struct {
+	Server    string `json:"server"`
+	Bind      string `json:"bind"`
+	Port      int    `json:"port"`
+	StoreDir  string `json:"store_dir"`
+	ClusterID string `json:"cluster_id"`
+	Topic     string `json:"topic"`
+}
+
+// UseStandalone replaces the poller and receiver streams with a single stream on
+// the embedded server, both share the same StreamConfig and so the same connection
+func (cfg *Config) UseStandalone() error {
+	if cfg.Standalone == nil {
+		cfg.Standalone = &StandaloneConfig{}
+	}
+
+	sa := cfg.Standalone
+
+	if sa.Bind == "" {
+		sa.Bind = "127.0.0.1"
+	}
+
+	if sa.Port == 0 {
+		sa.Port = 4222
+	}
+
+	if sa.ClusterID == "" {
+		sa.ClusterID = "prometheus_streams"
+	}
+
+	if sa.Topic == "" {
+		sa.Topic = "prometheus"
+	}
+
+	if cfg.SignScrapes || cfg.RequireSigned {
+		return fmt.Errorf("signed scrapes are not supported in standalone mode")
+	}
+
+	s := &StreamConfig{
+		Name:      "standalone",
+		ClientID:  "prometheus_streams_standalone",
+		ClusterID: sa.ClusterID,
+		URLs:      fmt.Sprintf("nats://%s:%d", sa.Bind, sa.Port),
+		Topic:     sa.Topic,
+	}
+
+	switch sa.Server {
+	case "", "jetstream":
+		sa.Server = "jetstream"
+		s.Transport = "jetstream"
+		s.JetStream = &JetStreamConfig{
+			Stream:  "PROMETHEUS",
+			Create:  true,
+			Storage: "file",
+		}
+
+		if sa.StoreDir == "" {
+			s.JetStream.Storage = "memory"
+		}
+
+	case "streaming":
+		s.Transport = "stan"
+
+	default:
+		return fmt.Errorf("invalid standalone server '%s', expected jetstream or streaming", sa.Server)
+	}
+
+	for _, prepare := range []func() error{s.parseStartAt, s.prepareTopics, s.prepareTransport, s.prepareTuning, s.preparePublish} {
+		err := prepare()
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.PollerStreams = StreamConfigs{s}
+	cfg.PollerStream = s
+	cfg.ReceiverStream = s
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package connection
+
+import (
+	"fmt"
+
+	"github.com/choria-io/prometheus-streams/config"
+	nats "github.com/nats-io/nats.go"
+)
+
+// natsAuthOptions creates the NATS connection options for the configured authentication method
+func natsAuthOptions(cfg *config.StreamConfig) ([]nats.Option, error) {
+	switch {
+	case cfg.Credentials != "":
+		return []nats.Option{nats.UserCredentials(cfg.Credentials)}, nil
+
+	case cfg.NKeySeed != "":
+		opt, err := nats.NkeyOptionFromSeed(cfg.NKeySeed)
+		if err != nil {
+			return nil, fmt.Errorf("could not load nkey seed %s: %s", cfg.NKeySeed, err)
+		}
+
+		return []nats.Option{opt}, nil
+
+	case cfg.Token != "":
+		return []nats.Option{nats.Token(cfg.Token)}, nil
+
+	case cfg.Username != "":
+		return []nats.Option{nats.UserInfo(cfg.Username, cfg.Password)}, nil
+
+	default:
+		return []nats.Option{}, nil
+	}
+}
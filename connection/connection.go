@@ -6,11 +6,10 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/choria-io/prometheus-streams/backoff"
 	"github.com/choria-io/prometheus-streams/config"
 	uuid "github.com/gofrs/uuid"
-	nats "github.com/nats-io/go-nats"
-	stan "github.com/nats-io/go-nats-streaming"
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,6 +21,8 @@ type Connection struct {
 	Conn stan.Conn
 	nc   *nats.Conn
 	tlsc *tls.Config
+	auth []nats.Option
+	cfg  *config.StreamConfig
 	log  *logrus.Entry
 }
 
@@ -40,6 +41,7 @@ func NewConnection(ctx context.Context, cfg *config.StreamConfig, log *logrus.En
 		name: cfg.ClientID,
 		cid:  cfg.ClusterID,
 		urls: cfg.URLs,
+		cfg:  cfg,
 		log:  log,
 	}
 
@@ -55,6 +57,12 @@ func NewConnection(ctx context.Context, cfg *config.StreamConfig, log *logrus.En
 		}
 	}
 
+	var err error
+	c.auth, err = natsAuthOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	c.connect(cb)
 
 	return &c, nil
@@ -81,6 +89,19 @@ func (c *Connection) Publish(target string, body []byte) error {
 	return c.Conn.Publish(target, body)
 }
 
+// PublishAsync implements Transport
+func (c *Connection) PublishAsync(target string, body []byte, ack func(err error)) error {
+	if c.Conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	_, err := c.Conn.PublishAsync(target, body, func(_ string, err error) {
+		ack(err)
+	})
+
+	return err
+}
+
 // PublishRaw implements lifecycle.PublishConnector
 func (c *Connection) PublishRaw(target string, body []byte) error {
 	if c.nc == nil {
@@ -92,6 +113,87 @@ func (c *Connection) PublishRaw(target string, body []byte) error {
 	return c.nc.Publish(target, body)
 }
 
+// Subscribe implements Transport
+func (c *Connection) Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error) {
+	if c.Conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	sopts := []stan.SubscriptionOption{}
+
+	if opts.Durable != "" {
+		sopts = append(sopts, stan.DurableName(opts.Durable))
+	}
+
+	if opts.ManualAck {
+		sopts = append(sopts, stan.SetManualAckMode())
+	}
+
+	if opts.MaxInflight > 0 {
+		sopts = append(sopts, stan.MaxInflight(opts.MaxInflight))
+	}
+
+	if opts.AckWait > 0 {
+		sopts = append(sopts, stan.AckWait(opts.AckWait))
+	}
+
+	switch {
+	case opts.StartSequence > 0:
+		sopts = append(sopts, stan.StartAtSequence(opts.StartSequence))
+	case !opts.StartTime.IsZero():
+		sopts = append(sopts, stan.StartAtTime(opts.StartTime))
+	case opts.StartAt == "last":
+		sopts = append(sopts, stan.StartWithLastReceived())
+	case opts.StartAt == "first":
+		sopts = append(sopts, stan.DeliverAllAvailable())
+	}
+
+	cb := func(m *stan.Msg) {
+		handler(&Message{
+			Subject:   m.Subject,
+			Sequence:  m.Sequence,
+			Timestamp: time.Unix(0, m.Timestamp),
+			Data:      m.Data,
+			ack:       m.Ack,
+		})
+	}
+
+	var sub stan.Subscription
+	var err error
+
+	if opts.QueueGroup != "" {
+		sub, err = c.Conn.QueueSubscribe(subject, opts.QueueGroup, cb, sopts...)
+	} else {
+		sub, err = c.Conn.Subscribe(subject, cb, sopts...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (c *Connection) stanOptions(cb func(stan.Conn, error)) []stan.Option {
+	options := []stan.Option{
+		stan.NatsConn(c.nc),
+		stan.SetConnectionLostHandler(func(conn stan.Conn, reason error) {
+			stanLostCtr.WithLabelValues(c.name).Inc()
+			cb(conn, reason)
+		}),
+	}
+
+	if c.cfg.PubAckWaitDuration > 0 {
+		options = append(options, stan.PubAckWait(c.cfg.PubAckWaitDuration))
+	}
+
+	if c.cfg.MaxPubAcksInflight > 0 {
+		options = append(options, stan.MaxPubAcksInflight(c.cfg.MaxPubAcksInflight))
+	}
+
+	return options
+}
+
 func (c *Connection) connectSTAN(cb func(stan.Conn, error)) stan.Conn {
 	c.nc = c.connectNATS()
 	if c.nc == nil {
@@ -106,7 +208,7 @@ func (c *Connection) connectSTAN(cb func(stan.Conn, error)) stan.Conn {
 	for {
 		try++
 
-		conn, err = stan.Connect(c.cid, c.name, stan.NatsConn(c.nc), stan.SetConnectionLostHandler(cb))
+		conn, err = stan.Connect(c.cid, c.name, c.stanOptions(cb)...)
 		if err != nil {
 			c.log.Warnf("%s initial connection to the NATS Streaming broker cluster failed: %s", c.name, err)
 
@@ -117,7 +219,7 @@ func (c *Connection) connectSTAN(cb func(stan.Conn, error)) stan.Conn {
 
 			c.log.Infof("%s NATS Stream client failed connection attempt %d", c.name, try)
 
-			if backoff.FiveSec.InterruptableSleep(c.ctx, try) != nil {
+			if backoffPolicy(c.cfg).InterruptableSleep(c.ctx, try) != nil {
 				return nil
 			}
 
@@ -147,6 +249,24 @@ func (c *Connection) connectNATS() (natsc *nats.Conn) {
 		options = append(options, nats.Secure(c.tlsc))
 	}
 
+	options = append(options, c.auth...)
+
+	if c.cfg.PingIntervalDuration > 0 {
+		options = append(options, nats.PingInterval(c.cfg.PingIntervalDuration))
+	}
+
+	if c.cfg.MaxPingsOut > 0 {
+		options = append(options, nats.MaxPingsOutstanding(c.cfg.MaxPingsOut))
+	}
+
+	if c.cfg.ReconnectWaitDuration > 0 {
+		options = append(options, nats.ReconnectWait(c.cfg.ReconnectWaitDuration))
+	}
+
+	if c.cfg.ConnectTimeoutDuration > 0 {
+		options = append(options, nats.Timeout(c.cfg.ConnectTimeoutDuration))
+	}
+
 	for {
 		try++
 
@@ -159,7 +279,7 @@ func (c *Connection) connectNATS() (natsc *nats.Conn) {
 				return nil
 			}
 
-			s := backoff.FiveSec.Duration(try)
+			s := backoffPolicy(c.cfg).Duration(try)
 			c.log.Infof("%s NATS client sleeping %s after failed connection attempt %d", c.name, s, try)
 
 			timer := time.NewTimer(s)
@@ -174,6 +294,7 @@ func (c *Connection) connectNATS() (natsc *nats.Conn) {
 		}
 
 		c.log.Infof("%s NATS client connected to %s", c.name, natsc.ConnectedUrl())
+		natsConnected(c.name, natsc.ConnectedUrl())
 
 		break
 	}
@@ -182,6 +303,9 @@ func (c *Connection) connectNATS() (natsc *nats.Conn) {
 }
 
 func (c *Connection) disconCb(nc *nats.Conn) {
+	natsDisconnectCtr.WithLabelValues(c.name).Inc()
+	natsConnected(c.name, "")
+
 	err := nc.LastError()
 
 	if err != nil {
@@ -192,10 +316,15 @@ func (c *Connection) disconCb(nc *nats.Conn) {
 }
 
 func (c *Connection) reconCb(nc *nats.Conn) {
+	natsReconnectCtr.WithLabelValues(c.name).Inc()
+	natsConnected(c.name, nc.ConnectedUrl())
+
 	c.log.Warnf("%s NATS client reconnected after a previous disconnection, connected to %s", nc.Opts.Name, nc.ConnectedUrl())
 }
 
 func (c *Connection) closedCb(nc *nats.Conn) {
+	natsConnected(c.name, "")
+
 	err := nc.LastError()
 
 	if err != nil {
@@ -207,5 +336,6 @@ func (c *Connection) closedCb(nc *nats.Conn) {
 }
 
 func (c *Connection) errorCb(nc *nats.Conn, sub *nats.Subscription, err error) {
+	natsErrorCtr.WithLabelValues(c.name).Inc()
 	c.log.Errorf("%s NATS client on %s encountered an error: %s", nc.Opts.Name, nc.ConnectedUrl(), err)
 }
@@ -0,0 +1,402 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Directory is a Transport that stores every message as a file below a directory,
+// any number of pollers and receivers on the same machine can share the directory.
+//
+// Messages are stored in <directory>/<subject>/<sequence>.msg, durable subscriptions
+// and queue groups claim messages by creating <directory>/<subject>/consumers/<name>/<sequence>
+// so that every message is handled once by the group
+type Directory struct {
+	ctx       context.Context
+	dir       string
+	retention time.Duration
+	interval  time.Duration
+	last      map[string]uint64
+	pruned    map[string]time.Time
+	log       *logrus.Entry
+
+	sync.Mutex
+}
+
+type directorySubscription struct {
+	transport *Directory
+	dir       string
+	claims    string
+	subject   string
+	next      uint64
+	handler   Handler
+	cancel    func()
+}
+
+// NewDirectory creates a transport storing messages in the configured directory
+func NewDirectory(ctx context.Context, cfg *config.StreamConfig, log *logrus.Entry) (*Directory, error) {
+	err := os.MkdirAll(cfg.Directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream directory %s: %s", cfg.Directory, err)
+	}
+
+	d := &Directory{
+		ctx:       ctx,
+		dir:       cfg.Directory,
+		retention: cfg.RetentionDuration,
+		interval:  time.Second,
+		last:      make(map[string]uint64),
+		pruned:    make(map[string]time.Time),
+		log:       log,
+	}
+
+	log.Infof("Using stream directory %s", d.dir)
+
+	return d, nil
+}
+
+// Publish implements Transport
+func (d *Directory) Publish(subject string, data []byte) error {
+	d.Lock()
+	defer d.Unlock()
+
+	sdir := filepath.Join(d.dir, subject)
+
+	err := os.MkdirAll(sdir, 0700)
+	if err != nil {
+		return fmt.Errorf("could not create subject directory: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(sdir, ".publish-")
+	if err != nil {
+		return fmt.Errorf("could not create message: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("could not write message: %s", err)
+	}
+
+	seq, ok := d.last[subject]
+	if !ok {
+		seqs, err := sequences(sdir)
+		if err != nil {
+			return err
+		}
+
+		if len(seqs) > 0 {
+			seq = seqs[len(seqs)-1]
+		}
+	}
+
+	// other processes might be publishing too, linking fails when the
+	// sequence is already taken so we just move on to the next one
+	for {
+		seq++
+
+		err = os.Link(tmp.Name(), messageFile(sdir, seq))
+		if err == nil {
+			break
+		}
+
+		if !os.IsExist(err) {
+			return fmt.Errorf("could not store message: %s", err)
+		}
+	}
+
+	d.last[subject] = seq
+
+	if time.Since(d.pruned[subject]) > time.Minute {
+		d.prune(sdir)
+		d.pruned[subject] = time.Now()
+	}
+
+	return nil
+}
+
+// PublishAsync implements Transport, publishing to a directory is always synchronous
+func (d *Directory) PublishAsync(subject string, data []byte, ack func(err error)) error {
+	err := d.Publish(subject, data)
+	if err != nil {
+		return err
+	}
+
+	ack(nil)
+
+	return nil
+}
+
+// PublishRaw implements Transport, there is no distinction between core and stream messages in a directory
+func (d *Directory) PublishRaw(subject string, data []byte) error {
+	return d.Publish(subject, data)
+}
+
+// Close implements Transport
+func (d *Directory) Close() {}
+
+// Subscribe implements Transport, messages are polled for every second and are
+// considered delivered once claimed, they are not redelivered
+func (d *Directory) Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error) {
+	sub := &directorySubscription{
+		transport: d,
+		dir:       filepath.Join(d.dir, subject),
+		subject:   subject,
+		handler:   handler,
+	}
+
+	err := os.MkdirAll(sub.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("could not create subject directory: %s", err)
+	}
+
+	name := opts.Durable
+	if opts.QueueGroup != "" {
+		name = opts.QueueGroup
+	}
+
+	if name != "" {
+		sub.claims = filepath.Join(sub.dir, "consumers", name)
+
+		err = os.MkdirAll(sub.claims, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("could not create consumer directory: %s", err)
+		}
+	}
+
+	sub.next, err = sub.start(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	sub.cancel = cancel
+
+	go sub.poll(ctx)
+
+	return sub, nil
+}
+
+// removes messages older than the retention period, the newest message is always
+// kept so that sequences never restart
+func (d *Directory) prune(sdir string) {
+	seqs, err := sequences(sdir)
+	if err != nil || len(seqs) == 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-d.retention)
+	oldest := seqs[len(seqs)-1]
+
+	for _, seq := range seqs[:len(seqs)-1] {
+		stat, err := os.Stat(messageFile(sdir, seq))
+		if err != nil {
+			continue
+		}
+
+		if stat.ModTime().After(cutoff) {
+			oldest = seq
+			break
+		}
+
+		err = os.Remove(messageFile(sdir, seq))
+		if err != nil {
+			d.log.Errorf("Could not remove expired message %d: %s", seq, err)
+		}
+	}
+
+	consumers, err := ioutil.ReadDir(filepath.Join(sdir, "consumers"))
+	if err != nil {
+		return
+	}
+
+	for _, consumer := range consumers {
+		cdir := filepath.Join(sdir, "consumers", consumer.Name())
+
+		claims, err := ioutil.ReadDir(cdir)
+		if err != nil {
+			continue
+		}
+
+		// the newest claim is kept so the consumer can resume after restarts
+		for i, claim := range claims {
+			seq, err := strconv.ParseUint(claim.Name(), 10, 64)
+			if err != nil || seq >= oldest || i == len(claims)-1 {
+				continue
+			}
+
+			os.Remove(filepath.Join(cdir, claim.Name()))
+		}
+	}
+}
+
+// start determines the first sequence to deliver, consumers that claimed messages
+// before resume after the last claim
+func (s *directorySubscription) start(opts SubscribeOptions) (uint64, error) {
+	if s.claims != "" {
+		claims, err := ioutil.ReadDir(s.claims)
+		if err != nil {
+			return 0, fmt.Errorf("could not read consumer directory: %s", err)
+		}
+
+		if len(claims) > 0 {
+			seq, err := strconv.ParseUint(claims[len(claims)-1].Name(), 10, 64)
+			if err == nil {
+				return seq + 1, nil
+			}
+		}
+	}
+
+	seqs, err := sequences(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var last uint64
+	if len(seqs) > 0 {
+		last = seqs[len(seqs)-1]
+	}
+
+	switch {
+	case opts.StartSequence > 0:
+		return opts.StartSequence, nil
+
+	case !opts.StartTime.IsZero():
+		for _, seq := range seqs {
+			stat, err := os.Stat(messageFile(s.dir, seq))
+			if err == nil && !stat.ModTime().Before(opts.StartTime) {
+				return seq, nil
+			}
+		}
+
+		return last + 1, nil
+
+	case opts.StartAt == "first":
+		return 0, nil
+
+	case opts.StartAt == "last" && last > 0:
+		return last, nil
+
+	default:
+		return last + 1, nil
+	}
+}
+
+func (s *directorySubscription) poll(ctx context.Context) {
+	ticker := time.NewTicker(s.transport.interval)
+	defer ticker.Stop()
+
+	for {
+		s.deliver(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *directorySubscription) deliver(ctx context.Context) {
+	seqs, err := sequences(s.dir)
+	if err != nil {
+		s.transport.log.Errorf("Could not list messages in %s: %s", s.dir, err)
+		return
+	}
+
+	for _, seq := range seqs {
+		if seq < s.next {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.next = seq + 1
+
+		if s.claims != "" {
+			claim, err := os.OpenFile(filepath.Join(s.claims, fmt.Sprintf("%020d", seq)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if os.IsExist(err) {
+				continue
+			}
+
+			if err != nil {
+				s.transport.log.Errorf("Could not claim message %d on %s: %s", seq, s.subject, err)
+				s.next = seq
+				return
+			}
+
+			claim.Close()
+		}
+
+		file := messageFile(s.dir, seq)
+
+		stat, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		s.handler(&Message{
+			Subject:   s.subject,
+			Sequence:  seq,
+			Timestamp: stat.ModTime(),
+			Data:      data,
+		})
+	}
+}
+
+// Unsubscribe implements Subscription
+func (s *directorySubscription) Unsubscribe() error {
+	s.cancel()
+
+	return nil
+}
+
+func messageFile(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.msg", seq))
+}
+
+// sequences lists the sequences of all messages in a subject directory in order
+func sequences(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read subject directory: %s", err)
+	}
+
+	seqs := []uint64{}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".msg") {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".msg"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
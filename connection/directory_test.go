@@ -0,0 +1,155 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+func newTestDirectory(t *testing.T, ctx context.Context, dir string) *Directory {
+	t.Helper()
+
+	d, err := NewDirectory(ctx, &config.StreamConfig{Directory: dir, RetentionDuration: time.Hour}, testLog())
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	d.interval = 10 * time.Millisecond
+
+	return d
+}
+
+func TestDirectoryOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newTestDirectory(t, ctx, t.TempDir())
+
+	publishAll(t, d, "prometheus", "one", "two", "three")
+
+	msgs := make(chan *Message, 10)
+	_, err := d.Subscribe("prometheus", SubscribeOptions{StartAt: "first"}, func(msg *Message) { msgs <- msg })
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	publishAll(t, d, "prometheus", "four")
+
+	received := receive(t, msgs, 4)
+	expectBodies(t, received, "one", "two", "three", "four")
+
+	for i, msg := range received {
+		if msg.Sequence != uint64(i+1) {
+			t.Errorf("expected sequence %d got %d", i+1, msg.Sequence)
+		}
+	}
+
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
+
+func TestDirectoryDurableResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	opts := SubscribeOptions{Durable: "receiver", StartAt: "first"}
+
+	d := newTestDirectory(t, ctx, dir)
+	publishAll(t, d, "prometheus", "one", "two")
+
+	msgs := make(chan *Message, 10)
+	sub, err := d.Subscribe("prometheus", opts, func(msg *Message) { msgs <- msg })
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	expectBodies(t, receive(t, msgs, 2), "one", "two")
+	sub.Unsubscribe()
+
+	// a new transport on the same directory behaves like a restarted process
+	d = newTestDirectory(t, ctx, dir)
+	publishAll(t, d, "prometheus", "three")
+
+	_, err = d.Subscribe("prometheus", opts, func(msg *Message) { msgs <- msg })
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	expectBodies(t, receive(t, msgs, 1), "three")
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
+
+func TestDirectoryQueueGroupSharing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	opts := SubscribeOptions{QueueGroup: "receivers", StartAt: "first"}
+	msgs := make(chan *Message, 40)
+
+	// each member of the group is its own process sharing the directory
+	for i := 0; i < 2; i++ {
+		_, err := newTestDirectory(t, ctx, dir).Subscribe("prometheus", opts, func(msg *Message) { msgs <- msg })
+		if err != nil {
+			t.Fatalf("subscribe failed: %s", err)
+		}
+	}
+
+	publisher := newTestDirectory(t, ctx, dir)
+	for i := 0; i < 20; i++ {
+		publishAll(t, publisher, "prometheus", fmt.Sprintf("%d", i))
+	}
+
+	seen := make(map[string]int)
+	for _, msg := range receive(t, msgs, 20) {
+		seen[string(msg.Data)]++
+	}
+
+	expectNothing(t, msgs, 100*time.Millisecond)
+
+	if len(seen) != 20 {
+		t.Fatalf("expected 20 unique messages got %d", len(seen))
+	}
+}
+
+func TestDirectoryRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	d := newTestDirectory(t, ctx, dir)
+	sdir := filepath.Join(dir, "prometheus")
+
+	publishAll(t, d, "prometheus", "one", "two", "three")
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, seq := range []uint64{1, 2} {
+		err := os.Chtimes(messageFile(sdir, seq), old, old)
+		if err != nil {
+			t.Fatalf("could not age message: %s", err)
+		}
+	}
+
+	// pruning happens at most once a minute while publishing
+	d.pruned["prometheus"] = time.Time{}
+	publishAll(t, d, "prometheus", "four")
+
+	seqs, err := sequences(sdir)
+	if err != nil {
+		t.Fatalf("could not list messages: %s", err)
+	}
+
+	if fmt.Sprintf("%v", seqs) != "[3 4]" {
+		t.Fatalf("expected messages 3 and 4 to be kept, found %v", seqs)
+	}
+
+	msgs := make(chan *Message, 10)
+	d.Subscribe("prometheus", SubscribeOptions{StartAt: "first"}, func(msg *Message) { msgs <- msg })
+
+	expectBodies(t, receive(t, msgs, 2), "three", "four")
+}
@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+// UnhealthyAfter is how long a supervised connection can be down before the process is considered unhealthy
+var UnhealthyAfter = 5 * time.Minute
+
+var supervisors []*Supervisor
+var expected []expectedSupervisor
+var supervisorsMu sync.Mutex
+
+type expectedSupervisor struct {
+	name string
+	cfg  *config.StreamConfig
+}
+
+// Expect registers a stream that will be supervised, the process is not ready until
+// a supervisor for every expected stream was created and connected
+func Expect(name string, cfg *config.StreamConfig) {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+
+	for _, e := range expected {
+		if e.cfg == cfg {
+			return
+		}
+	}
+
+	expected = append(expected, expectedSupervisor{name: name, cfg: cfg})
+}
+
+// Ready determines if every expected and supervised connection is connected with
+// all its subscriptions active, problems lists the reasons when not
+func Ready() (ready bool, problems []string) {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+
+	if len(expected) == 0 && len(supervisors) == 0 {
+		return false, []string{"no connections have been started"}
+	}
+
+	for _, e := range expected {
+		if supervisorFor(e.cfg) == nil {
+			problems = append(problems, fmt.Sprintf("%s has not been started", e.name))
+		}
+	}
+
+	for _, s := range supervisors {
+		p, _ := s.status()
+		problems = append(problems, p...)
+	}
+
+	return len(problems) == 0, problems
+}
+
+// Healthy determines if no supervised connection has been down for longer than
+// UnhealthyAfter, problems lists the connections that are down
+func Healthy() (healthy bool, problems []string) {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+
+	for _, s := range supervisors {
+		p, since := s.status()
+		if len(p) > 0 && since > UnhealthyAfter {
+			problems = append(problems, p...)
+		}
+	}
+
+	return len(problems) == 0, problems
+}
+
+// supervisorFor finds the supervisor for a stream, must be called with supervisorsMu held
+func supervisorFor(cfg *config.StreamConfig) *Supervisor {
+	for _, s := range supervisors {
+		if s.cfg == cfg {
+			return s
+		}
+	}
+
+	return nil
+}
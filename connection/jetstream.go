@@ -0,0 +1,506 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	uuid "github.com/gofrs/uuid"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// JetStream is a Transport using NATS JetStream
+type JetStream struct {
+	ctx  context.Context
+	name string
+	urls string
+	cfg  *config.JetStreamConfig
+	nc   *natsgo.Conn
+	js   natsgo.JetStreamContext
+	tlsc *tls.Config
+	auth []natsgo.Option
+	scfg *config.StreamConfig
+	log  *logrus.Entry
+	lost func(reason error)
+
+	sync.Mutex
+}
+
+// NewJetStream connects to NATS and ensures the configured stream exists
+func NewJetStream(ctx context.Context, cfg *config.StreamConfig, log *logrus.Entry, lost func(reason error)) (*JetStream, error) {
+	if cfg.ClientID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientID = fmt.Sprintf("prometheus_streams_%s", id.String())
+	}
+
+	j := &JetStream{
+		ctx:  ctx,
+		name: cfg.ClientID,
+		urls: cfg.URLs,
+		cfg:  cfg.JetStream,
+		scfg: cfg,
+		log:  log,
+		lost: lost,
+	}
+
+	if cfg.TLS != nil {
+		prov, err := cfg.TLS.SecurityProvider()
+		if err != nil {
+			return nil, fmt.Errorf("could not initiate security system: %s", err)
+		}
+
+		j.tlsc, err = prov.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("could not configure TLS settings: %s", err)
+		}
+	}
+
+	var err error
+	j.auth, err = natsAuthOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	jopts := []natsgo.JSOpt{}
+
+	if cfg.PubAckWaitDuration > 0 {
+		jopts = append(jopts, natsgo.MaxWait(cfg.PubAckWaitDuration))
+	}
+
+	if cfg.MaxPubAcksInflight > 0 {
+		jopts = append(jopts, natsgo.PublishAsyncMaxPending(cfg.MaxPubAcksInflight))
+	}
+
+	j.js, err = j.nc.JetStream(jopts...)
+	if err != nil {
+		j.nc.Close()
+		return nil, fmt.Errorf("could not create JetStream context: %s", err)
+	}
+
+	if j.cfg.Create || j.cfg.Update {
+		err = j.createStream()
+		if err != nil {
+			j.nc.Close()
+			return nil, err
+		}
+	}
+
+	return j, nil
+}
+
+func (j *JetStream) connect() error {
+	options := []natsgo.Option{
+		natsgo.MaxReconnects(-1),
+		natsgo.Name(j.name),
+		natsgo.DisconnectErrHandler(func(nc *natsgo.Conn, err error) {
+			natsDisconnectCtr.WithLabelValues(j.name).Inc()
+			natsConnected(j.name, "")
+			j.log.Warnf("%s NATS client connection got disconnected: %v", j.name, err)
+		}),
+		natsgo.ReconnectHandler(func(nc *natsgo.Conn) {
+			natsReconnectCtr.WithLabelValues(j.name).Inc()
+			natsConnected(j.name, nc.ConnectedUrl())
+			j.log.Warnf("%s NATS client reconnected after a previous disconnection, connected to %s", j.name, nc.ConnectedUrl())
+		}),
+		natsgo.ClosedHandler(func(nc *natsgo.Conn) {
+			natsConnected(j.name, "")
+			j.log.Warnf("%s NATS client connection closed", j.name)
+
+			lost := j.lostHandler()
+			if j.ctx.Err() == nil && lost != nil {
+				lost(fmt.Errorf("connection closed: %v", nc.LastError()))
+			}
+		}),
+		natsgo.ErrorHandler(func(nc *natsgo.Conn, sub *natsgo.Subscription, err error) {
+			natsErrorCtr.WithLabelValues(j.name).Inc()
+			j.log.Errorf("%s NATS client on %s encountered an error: %s", j.name, nc.ConnectedUrl(), err)
+		}),
+	}
+
+	if j.tlsc != nil {
+		options = append(options, natsgo.Secure(j.tlsc))
+	}
+
+	options = append(options, j.auth...)
+
+	if j.scfg.PingIntervalDuration > 0 {
+		options = append(options, natsgo.PingInterval(j.scfg.PingIntervalDuration))
+	}
+
+	if j.scfg.MaxPingsOut > 0 {
+		options = append(options, natsgo.MaxPingsOutstanding(j.scfg.MaxPingsOut))
+	}
+
+	if j.scfg.ReconnectWaitDuration > 0 {
+		options = append(options, natsgo.ReconnectWait(j.scfg.ReconnectWaitDuration))
+	}
+
+	if j.scfg.ReconnectJitterDuration > 0 {
+		options = append(options, natsgo.ReconnectJitter(j.scfg.ReconnectJitterDuration, j.scfg.ReconnectJitterDuration))
+	}
+
+	if j.scfg.ConnectTimeoutDuration > 0 {
+		options = append(options, natsgo.Timeout(j.scfg.ConnectTimeoutDuration))
+	}
+
+	var err error
+	try := 0
+
+	for {
+		try++
+
+		j.nc, err = natsgo.Connect(j.urls, options...)
+		if err == nil {
+			break
+		}
+
+		j.log.Warnf("%s initial connection to the NATS broker cluster failed: %s", j.name, err)
+
+		if backoffPolicy(j.scfg).InterruptableSleep(j.ctx, try) != nil {
+			return fmt.Errorf("initial connection cancelled due to shut down")
+		}
+	}
+
+	j.log.Infof("%s NATS client connected to %s", j.name, j.nc.ConnectedUrl())
+	natsConnected(j.name, j.nc.ConnectedUrl())
+
+	return nil
+}
+
+// createStream creates the stream when it does not exist, an existing stream is only
+// updated when update is set as pollers and receivers might configure it differently
+func (j *JetStream) createStream() error {
+	scfg := &natsgo.StreamConfig{
+		Name:     j.cfg.Stream,
+		Subjects: j.cfg.Subjects,
+		MaxAge:   j.cfg.MaxAgeDuration,
+		Replicas: j.cfg.Replicas,
+		Storage:  natsgo.FileStorage,
+	}
+
+	if j.cfg.Storage == "memory" {
+		scfg.Storage = natsgo.MemoryStorage
+	}
+
+	info, err := j.js.StreamInfo(j.cfg.Stream)
+	if err == natsgo.ErrStreamNotFound {
+		if !j.cfg.Create {
+			return fmt.Errorf("stream %s does not exist", j.cfg.Stream)
+		}
+
+		_, err = j.js.AddStream(scfg)
+		if err != nil {
+			return fmt.Errorf("could not create stream %s: %s", j.cfg.Stream, err)
+		}
+
+		j.log.Infof("Created JetStream stream %s", j.cfg.Stream)
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not look up stream %s: %s", j.cfg.Stream, err)
+	}
+
+	if info.Config.Storage != scfg.Storage {
+		j.log.Warnf("JetStream stream %s uses %s storage rather than %s, storage can not be changed on an existing stream", j.cfg.Stream, info.Config.Storage, j.cfg.Storage)
+	}
+
+	differences := streamDifferences(&info.Config, scfg)
+	if len(differences) == 0 {
+		return nil
+	}
+
+	if !j.cfg.Update {
+		j.log.Warnf("JetStream stream %s differs from the configuration in %s, not updating it", j.cfg.Stream, strings.Join(differences, ", "))
+		return nil
+	}
+
+	// settings not managed by the configuration are kept as they are
+	ucfg := info.Config
+	ucfg.Subjects = scfg.Subjects
+	ucfg.MaxAge = scfg.MaxAge
+	ucfg.Replicas = scfg.Replicas
+
+	_, err = j.js.UpdateStream(&ucfg)
+	if err != nil {
+		return fmt.Errorf("could not update stream %s: %s", j.cfg.Stream, err)
+	}
+
+	j.log.Infof("Updated the %s of JetStream stream %s", strings.Join(differences, ", "), j.cfg.Stream)
+
+	return nil
+}
+
+// streamDifferences lists the settings that can be updated that differ between an
+// existing stream and the desired one
+func streamDifferences(existing *natsgo.StreamConfig, desired *natsgo.StreamConfig) []string {
+	differences := []string{}
+
+	subjects := func(s []string) string {
+		c := append([]string{}, s...)
+		sort.Strings(c)
+
+		return strings.Join(c, ",")
+	}
+
+	if subjects(existing.Subjects) != subjects(desired.Subjects) {
+		differences = append(differences, "subjects")
+	}
+
+	if existing.MaxAge != desired.MaxAge {
+		differences = append(differences, "max_age")
+	}
+
+	// 0 and 1 replicas are the same
+	if existing.Replicas != desired.Replicas && existing.Replicas+desired.Replicas > 1 {
+		differences = append(differences, "replicas")
+	}
+
+	return differences
+}
+
+// Publish implements Transport, it waits for the stream to acknowledge the message
+func (j *JetStream) Publish(subject string, data []byte) error {
+	_, err := j.js.Publish(subject, data)
+	return err
+}
+
+// PublishAsync implements Transport
+func (j *JetStream) PublishAsync(subject string, data []byte, ack func(err error)) error {
+	future, err := j.js.PublishAsync(subject, data)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-future.Ok():
+			ack(nil)
+		case err := <-future.Err():
+			ack(err)
+		case <-j.ctx.Done():
+			ack(j.ctx.Err())
+		}
+	}()
+
+	return nil
+}
+
+// PublishRaw implements Transport
+func (j *JetStream) PublishRaw(subject string, data []byte) error {
+	j.log.Infof("publishing to %s on %s", subject, j.nc.ConnectedUrl())
+	return j.nc.Publish(subject, data)
+}
+
+// Close implements Transport, closing the connection does not count as losing it
+func (j *JetStream) Close() {
+	j.Lock()
+	j.lost = nil
+	j.Unlock()
+
+	j.nc.Close()
+}
+
+func (j *JetStream) lostHandler() func(reason error) {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.lost
+}
+
+// Subscribe implements Transport, durable subscriptions use a pull consumer when
+// configured while ephemeral ones always use a push consumer
+func (j *JetStream) Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error) {
+	durable := opts.Durable
+	if opts.QueueGroup != "" {
+		durable = opts.QueueGroup
+	}
+
+	ackWait := j.cfg.AckWaitDuration
+	if opts.AckWait > 0 {
+		ackWait = opts.AckWait
+	}
+
+	sopts := []natsgo.SubOpt{natsgo.AckWait(ackWait)}
+
+	if j.cfg.Stream != "" {
+		sopts = append(sopts, natsgo.BindStream(j.cfg.Stream))
+	}
+
+	if opts.ManualAck {
+		sopts = append(sopts, natsgo.ManualAck())
+	}
+
+	switch {
+	case opts.MaxInflight > 0 && j.cfg.MaxAckPending == 0:
+		sopts = append(sopts, natsgo.MaxAckPending(opts.MaxInflight))
+	case j.cfg.MaxAckPending > 0:
+		sopts = append(sopts, natsgo.MaxAckPending(j.cfg.MaxAckPending))
+	}
+
+	// a durable that exists resumes where it left off, nats.go rejects start options
+	// that differ from the ones it was created with like a recalculated start time
+	resume := false
+	if durable != "" {
+		var err error
+
+		resume, err = j.consumerExists(subject, durable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case resume:
+	case opts.StartSequence > 0:
+		sopts = append(sopts, natsgo.StartSequence(opts.StartSequence))
+	case !opts.StartTime.IsZero():
+		sopts = append(sopts, natsgo.StartTime(opts.StartTime))
+	case opts.StartAt == "last":
+		sopts = append(sopts, natsgo.DeliverLast())
+	case opts.StartAt == "first":
+		sopts = append(sopts, natsgo.DeliverAll())
+	default:
+		sopts = append(sopts, natsgo.DeliverNew())
+	}
+
+	cb := func(m *natsgo.Msg) {
+		msg := &Message{
+			Subject: m.Subject,
+			Data:    m.Data,
+			ack:     func() error { return m.Ack() },
+		}
+
+		meta, err := m.Metadata()
+		if err == nil {
+			msg.Sequence = meta.Sequence.Stream
+			msg.Timestamp = meta.Timestamp
+		}
+
+		handler(msg)
+	}
+
+	if j.cfg.Consumer == "pull" && durable != "" {
+		sub, err := j.js.PullSubscribe(subject, durable, sopts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return j.pull(sub, cb), nil
+	}
+
+	// pull consumers take the durable name as an argument, push consumers as an option
+	if durable != "" {
+		sopts = append(sopts, natsgo.Durable(durable))
+	}
+
+	var sub *natsgo.Subscription
+	var err error
+
+	if opts.QueueGroup != "" {
+		sub, err = j.js.QueueSubscribe(subject, opts.QueueGroup, cb, sopts...)
+	} else {
+		sub, err = j.js.Subscribe(subject, cb, sopts...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// consumerExists determines if the durable consumer for subject was already created
+func (j *JetStream) consumerExists(subject string, durable string) (bool, error) {
+	stream := j.cfg.Stream
+	if stream == "" {
+		var err error
+
+		stream, err = j.js.StreamNameBySubject(subject)
+		if err != nil {
+			return false, fmt.Errorf("could not find the stream for %s: %s", subject, err)
+		}
+	}
+
+	_, err := j.js.ConsumerInfo(stream, durable)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, natsgo.ErrConsumerNotFound):
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not look up consumer %s: %s", durable, err)
+	}
+}
+
+// pullSubscription fetches batches of messages from a pull consumer until unsubscribed
+type pullSubscription struct {
+	sub    *natsgo.Subscription
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+func (j *JetStream) pull(sub *natsgo.Subscription, cb func(*natsgo.Msg)) *pullSubscription {
+	ctx, cancel := context.WithCancel(j.ctx)
+	ps := &pullSubscription{sub: sub, cancel: cancel}
+
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			fctx, fcancel := context.WithTimeout(ctx, 5*time.Second)
+			msgs, err := sub.Fetch(j.cfg.PullBatch, natsgo.Context(fctx))
+			fcancel()
+
+			if err != nil && err != context.DeadlineExceeded && err != natsgo.ErrTimeout {
+				if ctx.Err() != nil {
+					return
+				}
+
+				j.log.Warnf("Fetching messages from %s failed: %s", sub.Subject, err)
+
+				if backoffPolicy(j.scfg).InterruptableSleep(ctx, 1) != nil {
+					return
+				}
+
+				continue
+			}
+
+			for _, m := range msgs {
+				cb(m)
+			}
+		}
+	}()
+
+	return ps
+}
+
+// Unsubscribe implements Subscription
+func (p *pullSubscription) Unsubscribe() error {
+	p.cancel()
+	p.wg.Wait()
+
+	return p.sub.Unsubscribe()
+}
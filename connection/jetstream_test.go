@@ -0,0 +1,299 @@
+package connection
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	natsd "github.com/nats-io/nats-server/v2/server"
+	"github.com/sirupsen/logrus"
+)
+
+func testLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	return logrus.NewEntry(logger)
+}
+
+// startJetStreamServer runs an embedded nats-server with JetStream enabled for the duration of the test
+func startJetStreamServer(t *testing.T) *natsd.Server {
+	t.Helper()
+
+	srv, err := natsd.NewServer(&natsd.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+		NoLog:     true,
+	})
+	if err != nil {
+		t.Fatalf("could not create server: %s", err)
+	}
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatalf("server did not become ready")
+	}
+
+	t.Cleanup(srv.Shutdown)
+
+	return srv
+}
+
+func jetStreamConfig(srv *natsd.Server, consumer string) *config.StreamConfig {
+	return &config.StreamConfig{
+		ClientID:  "prometheus_test",
+		URLs:      srv.ClientURL(),
+		Topic:     "prometheus",
+		Transport: "jetstream",
+		JetStream: &config.JetStreamConfig{
+			Stream:          "PROMETHEUS",
+			Create:          true,
+			Subjects:        []string{"prometheus"},
+			MaxAgeDuration:  time.Hour,
+			Storage:         "file",
+			Consumer:        consumer,
+			AckWaitDuration: 30 * time.Second,
+			PullBatch:       10,
+		},
+	}
+}
+
+func newTestJetStream(t *testing.T, ctx context.Context, cfg *config.StreamConfig, lost func(error)) *JetStream {
+	t.Helper()
+
+	j, err := NewJetStream(ctx, cfg, testLog(), lost)
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+
+	return j
+}
+
+// receive collects messages from a subscription until count were received or the timeout passed
+func receive(t *testing.T, msgs chan *Message, count int) []*Message {
+	t.Helper()
+
+	received := []*Message{}
+	timeout := time.After(10 * time.Second)
+
+	for len(received) < count {
+		select {
+		case msg := <-msgs:
+			received = append(received, msg)
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", len(received), count)
+		}
+	}
+
+	return received
+}
+
+func TestJetStreamPublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := startJetStreamServer(t)
+	j := newTestJetStream(t, ctx, jetStreamConfig(srv, "push"), nil)
+	defer j.Close()
+
+	for _, body := range []string{"one", "two", "three"} {
+		err := j.Publish("prometheus", []byte(body))
+		if err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+	}
+
+	msgs := make(chan *Message, 10)
+	_, err := j.Subscribe("prometheus", SubscribeOptions{StartAt: "first"}, func(msg *Message) { msgs <- msg })
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	for i, msg := range receive(t, msgs, 3) {
+		if msg.Sequence != uint64(i+1) {
+			t.Errorf("expected sequence %d got %d", i+1, msg.Sequence)
+		}
+
+		if string(msg.Data) != []string{"one", "two", "three"}[i] {
+			t.Errorf("unexpected message %q at %d", msg.Data, i)
+		}
+	}
+}
+
+func TestJetStreamPublishAsync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := startJetStreamServer(t)
+	j := newTestJetStream(t, ctx, jetStreamConfig(srv, "push"), nil)
+	defer j.Close()
+
+	acks := make(chan error, 1)
+
+	err := j.PublishAsync("prometheus", []byte("one"), func(err error) { acks <- err })
+	if err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+
+	select {
+	case err := <-acks:
+		if err != nil {
+			t.Fatalf("publish was not acknowledged: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no acknowledgement received")
+	}
+}
+
+func TestJetStreamDurableResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := startJetStreamServer(t)
+	cfg := jetStreamConfig(srv, "pull")
+	opts := SubscribeOptions{Durable: "receiver", StartAt: "first", ManualAck: true}
+
+	j := newTestJetStream(t, ctx, cfg, nil)
+
+	for _, body := range []string{"one", "two"} {
+		j.Publish("prometheus", []byte(body))
+	}
+
+	msgs := make(chan *Message, 10)
+	sub, err := j.Subscribe("prometheus", opts, func(msg *Message) {
+		msg.Ack()
+		msgs <- msg
+	})
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	receive(t, msgs, 2)
+
+	// stop fetching without deleting the durable, as happens when the connection is lost
+	sub.(*pullSubscription).cancel()
+	sub.(*pullSubscription).wg.Wait()
+	j.Close()
+
+	j = newTestJetStream(t, ctx, cfg, nil)
+	defer j.Close()
+
+	j.Publish("prometheus", []byte("three"))
+
+	msgs = make(chan *Message, 10)
+	_, err = j.Subscribe("prometheus", opts, func(msg *Message) {
+		msg.Ack()
+		msgs <- msg
+	})
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	received := receive(t, msgs, 1)
+	if string(received[0].Data) != "three" {
+		t.Fatalf("expected the durable to resume with three, got %q", received[0].Data)
+	}
+}
+
+func TestJetStreamDurableRestartWithStartTime(t *testing.T) {
+	for _, consumer := range []string{"push", "pull"} {
+		t.Run(consumer, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			srv := startJetStreamServer(t)
+			cfg := jetStreamConfig(srv, consumer)
+
+			j := newTestJetStream(t, ctx, cfg, nil)
+			j.Publish("prometheus", []byte("one"))
+
+			// a receiver with start_at set to a duration calculates a new start time on every start
+			subscribe := func(j *JetStream) chan *Message {
+				msgs := make(chan *Message, 10)
+				opts := SubscribeOptions{Durable: "receiver", StartTime: time.Now().Add(-time.Hour), ManualAck: true}
+
+				_, err := j.Subscribe("prometheus", opts, func(msg *Message) {
+					msg.Ack()
+					msgs <- msg
+				})
+				if err != nil {
+					t.Fatalf("subscribe failed: %s", err)
+				}
+
+				return msgs
+			}
+
+			receive(t, subscribe(j), 1)
+			j.Close()
+
+			time.Sleep(10 * time.Millisecond)
+
+			j = newTestJetStream(t, ctx, cfg, nil)
+			defer j.Close()
+
+			j.Publish("prometheus", []byte("two"))
+
+			received := receive(t, subscribe(j), 1)
+			if string(received[0].Data) != "two" {
+				t.Fatalf("expected the durable to resume with two, got %q", received[0].Data)
+			}
+		})
+	}
+}
+
+func TestJetStreamCreateDoesNotUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := startJetStreamServer(t)
+
+	owner := newTestJetStream(t, ctx, jetStreamConfig(srv, "push"), nil)
+	defer owner.Close()
+
+	maxAge := func() time.Duration {
+		info, err := owner.js.StreamInfo("PROMETHEUS")
+		if err != nil {
+			t.Fatalf("could not look up stream: %s", err)
+		}
+
+		return info.Config.MaxAge
+	}
+
+	other := jetStreamConfig(srv, "push")
+	other.JetStream.MaxAgeDuration = 2 * time.Hour
+	newTestJetStream(t, ctx, other, nil).Close()
+
+	if maxAge() != time.Hour {
+		t.Fatalf("stream was updated by a process that does not own it, max age is %s", maxAge())
+	}
+
+	other.JetStream.Update = true
+	newTestJetStream(t, ctx, other, nil).Close()
+
+	if maxAge() != 2*time.Hour {
+		t.Fatalf("stream was not updated by its owner, max age is %s", maxAge())
+	}
+}
+
+func TestJetStreamCloseIsNotLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := startJetStreamServer(t)
+
+	lost := make(chan error, 1)
+	j := newTestJetStream(t, ctx, jetStreamConfig(srv, "push"), func(reason error) { lost <- reason })
+	j.Close()
+
+	select {
+	case reason := <-lost:
+		t.Fatalf("closing the connection reported it lost: %s", reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
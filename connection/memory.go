@@ -0,0 +1,439 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/sirupsen/logrus"
+)
+
+var brokers = make(map[string]*memoryBroker)
+var brokersMu sync.Mutex
+
+// memoryBroker is an in process Stream shared by all Memory transports with the
+// same cluster id, messages are kept for the retention period
+type memoryBroker struct {
+	messages  map[string][]*Message
+	sequences map[string]uint64
+	consumers map[string]*memoryConsumer
+	retention time.Duration
+	ephemeral int
+
+	sync.Mutex
+}
+
+// memoryConsumer delivers messages to its handlers in a round robin fashion,
+// durable consumers and queue groups keep their position between subscriptions.
+//
+// With manual acks at most maxInflight messages are delivered without being
+// acknowledged and those not acknowledged within ackWait are delivered again
+type memoryConsumer struct {
+	broker      *memoryBroker
+	key         string
+	durable     bool
+	subject     string
+	next        uint64
+	manualAck   bool
+	ackWait     time.Duration
+	maxInflight int
+	unacked     map[uint64]time.Time
+	handlers    []*memorySubscription
+	notify      chan struct{}
+	delivering  context.Context
+	cancel      func()
+	idx         int
+
+	sync.Mutex
+}
+
+type memorySubscription struct {
+	ctx      context.Context
+	consumer *memoryConsumer
+	handler  Handler
+}
+
+// Memory is a Transport that keeps messages in memory, it is intended for tests
+// and for running the poller and receiver in one process
+type Memory struct {
+	ctx    context.Context
+	broker *memoryBroker
+	log    *logrus.Entry
+}
+
+// NewMemory creates a transport connected to the in memory broker named after the cluster id
+func NewMemory(ctx context.Context, cfg *config.StreamConfig, log *logrus.Entry) (*Memory, error) {
+	brokersMu.Lock()
+	defer brokersMu.Unlock()
+
+	broker, ok := brokers[cfg.ClusterID]
+	if !ok {
+		broker = &memoryBroker{
+			messages:  make(map[string][]*Message),
+			sequences: make(map[string]uint64),
+			consumers: make(map[string]*memoryConsumer),
+			retention: cfg.RetentionDuration,
+		}
+
+		brokers[cfg.ClusterID] = broker
+
+		log.Infof("Created in memory stream %s", cfg.ClusterID)
+	}
+
+	return &Memory{ctx: ctx, broker: broker, log: log}, nil
+}
+
+// Publish implements Transport
+func (m *Memory) Publish(subject string, data []byte) error {
+	m.broker.publish(subject, data)
+	return nil
+}
+
+// PublishAsync implements Transport, publishing in memory is always synchronous
+func (m *Memory) PublishAsync(subject string, data []byte, ack func(err error)) error {
+	err := m.Publish(subject, data)
+	if err != nil {
+		return err
+	}
+
+	ack(nil)
+
+	return nil
+}
+
+// PublishRaw implements Transport, there is no distinction between core and stream messages in memory
+func (m *Memory) PublishRaw(subject string, data []byte) error {
+	return m.Publish(subject, data)
+}
+
+// Close implements Transport
+func (m *Memory) Close() {}
+
+// Subscribe implements Transport, with manual acks messages that are not acknowledged
+// within the ack wait are redelivered else they are delivered once
+func (m *Memory) Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error) {
+	return m.broker.subscribe(m.ctx, subject, opts, handler), nil
+}
+
+func (b *memoryBroker) publish(subject string, data []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.sequences[subject]++
+
+	msg := &Message{
+		Subject:   subject,
+		Sequence:  b.sequences[subject],
+		Timestamp: time.Now(),
+		Data:      append([]byte{}, data...),
+	}
+
+	b.messages[subject] = append(b.messages[subject], msg)
+	b.expire(subject)
+
+	for _, c := range b.consumers {
+		if c.subject == subject {
+			c.wake()
+		}
+	}
+}
+
+// expire removes messages older than the retention period, must be called with the lock held
+func (b *memoryBroker) expire(subject string) {
+	if b.retention <= 0 {
+		return
+	}
+
+	msgs := b.messages[subject]
+	cutoff := time.Now().Add(-b.retention)
+
+	i := 0
+	for i < len(msgs) && msgs[i].Timestamp.Before(cutoff) {
+		i++
+	}
+
+	b.messages[subject] = msgs[i:]
+}
+
+// startSequence determines the first sequence a new consumer receives, must be called with the lock held
+func (b *memoryBroker) startSequence(subject string, opts SubscribeOptions) uint64 {
+	last := b.sequences[subject]
+
+	switch {
+	case opts.StartSequence > 0:
+		return opts.StartSequence
+
+	case !opts.StartTime.IsZero():
+		for _, msg := range b.messages[subject] {
+			if !msg.Timestamp.Before(opts.StartTime) {
+				return msg.Sequence
+			}
+		}
+
+		return last + 1
+
+	case opts.StartAt == "first":
+		return 1
+
+	case opts.StartAt == "last" && last > 0:
+		return last
+
+	default:
+		return last + 1
+	}
+}
+
+func (b *memoryBroker) subscribe(ctx context.Context, subject string, opts SubscribeOptions, handler Handler) *memorySubscription {
+	b.Lock()
+	defer b.Unlock()
+
+	name := opts.Durable
+	if opts.QueueGroup != "" {
+		name = opts.QueueGroup
+	}
+
+	if name == "" {
+		b.ephemeral++
+		name = fmt.Sprintf("_ephemeral.%d", b.ephemeral)
+	}
+
+	key := subject + "/" + name
+
+	c, ok := b.consumers[key]
+	if !ok {
+		c = &memoryConsumer{
+			broker:      b,
+			key:         key,
+			durable:     opts.Durable != "" || opts.QueueGroup != "",
+			subject:     subject,
+			next:        b.startSequence(subject, opts),
+			manualAck:   opts.ManualAck,
+			ackWait:     opts.AckWait,
+			maxInflight: opts.MaxInflight,
+			unacked:     make(map[uint64]time.Time),
+			notify:      make(chan struct{}, 1),
+		}
+
+		if c.ackWait <= 0 {
+			c.ackWait = 30 * time.Second
+		}
+
+		b.consumers[key] = c
+	}
+
+	sub := &memorySubscription{ctx: ctx, consumer: c, handler: handler}
+
+	c.Lock()
+	c.handlers = append(c.active(), sub)
+
+	// delivery stops when the transport that started it shuts down, durables
+	// outlive transports so a new subscription starts it again
+	if c.cancel == nil || c.delivering.Err() != nil {
+		c.delivering, c.cancel = context.WithCancel(ctx)
+		go c.deliver(c.delivering)
+	}
+	c.Unlock()
+
+	c.wake()
+
+	return sub
+}
+
+func (c *memoryConsumer) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// message finds a stored message, nil when it expired, must be called with the broker lock held
+func (b *memoryBroker) message(subject string, seq uint64) *Message {
+	for _, msg := range b.messages[subject] {
+		if msg.Sequence == seq {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// ready is the messages to deliver next, unacknowledged messages that are due for
+// redelivery followed by messages not yet received while the inflight limit allows
+func (c *memoryConsumer) ready() []*Message {
+	c.broker.Lock()
+	defer c.broker.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+
+	ready := []*Message{}
+	now := time.Now()
+
+	for seq, deadline := range c.unacked {
+		if deadline.After(now) {
+			continue
+		}
+
+		msg := c.broker.message(c.subject, seq)
+		if msg == nil {
+			delete(c.unacked, seq)
+			continue
+		}
+
+		c.unacked[seq] = now.Add(c.ackWait)
+		ready = append(ready, c.prepare(msg))
+	}
+
+	sort.Slice(ready, func(i, j int) bool { return ready[i].Sequence < ready[j].Sequence })
+
+	for _, msg := range c.broker.messages[c.subject] {
+		if msg.Sequence < c.next {
+			continue
+		}
+
+		if c.manualAck && c.maxInflight > 0 && len(c.unacked) >= c.maxInflight {
+			break
+		}
+
+		c.next = msg.Sequence + 1
+
+		if c.manualAck {
+			c.unacked[msg.Sequence] = now.Add(c.ackWait)
+		}
+
+		ready = append(ready, c.prepare(msg))
+	}
+
+	return ready
+}
+
+// prepare copies a stored message for delivery, acknowledging it removes it from the
+// unacknowledged messages, must be called with the consumer lock held
+func (c *memoryConsumer) prepare(msg *Message) *Message {
+	m := *msg
+
+	if c.manualAck {
+		m.ack = func() error {
+			c.Lock()
+			delete(c.unacked, m.Sequence)
+			c.Unlock()
+
+			c.wake()
+
+			return nil
+		}
+	}
+
+	return &m
+}
+
+// redeliverAfter is how long until the next unacknowledged message is due for redelivery
+func (c *memoryConsumer) redeliverAfter() (time.Duration, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	var next time.Time
+
+	for _, deadline := range c.unacked {
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+
+	if next.IsZero() {
+		return 0, false
+	}
+
+	return time.Until(next), true
+}
+
+// active is the handlers of subscriptions whose transport was not shut down, must be
+// called with the consumer lock held
+func (c *memoryConsumer) active() []*memorySubscription {
+	active := []*memorySubscription{}
+
+	for _, sub := range c.handlers {
+		if sub.ctx.Err() == nil {
+			active = append(active, sub)
+		}
+	}
+
+	return active
+}
+
+func (c *memoryConsumer) deliver(ctx context.Context) {
+	for {
+		for _, msg := range c.ready() {
+			c.Lock()
+			c.handlers = c.active()
+
+			if len(c.handlers) == 0 || ctx.Err() != nil {
+				// undelivered messages are redelivered when using manual acks, else the
+				// position is rewound so that a durable resumes with them
+				if !c.manualAck && msg.Sequence < c.next {
+					c.next = msg.Sequence
+				}
+
+				c.Unlock()
+				return
+			}
+
+			c.idx = (c.idx + 1) % len(c.handlers)
+			handler := c.handlers[c.idx].handler
+			c.Unlock()
+
+			handler(msg)
+		}
+
+		timer := time.NewTimer(time.Hour)
+		if after, ok := c.redeliverAfter(); ok {
+			timer.Reset(after)
+		}
+
+		select {
+		case <-c.notify:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		timer.Stop()
+	}
+}
+
+// Unsubscribe implements Subscription
+func (s *memorySubscription) Unsubscribe() error {
+	c := s.consumer
+
+	c.broker.Lock()
+	defer c.broker.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+
+	for i, sub := range c.handlers {
+		if sub == s {
+			c.handlers = append(c.handlers[:i], c.handlers[i+1:]...)
+			break
+		}
+	}
+
+	if len(c.handlers) > 0 {
+		return nil
+	}
+
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+
+	if !c.durable {
+		delete(c.broker.consumers, c.key)
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+var testBrokers int
+
+// newTestMemory creates a transport on a new broker, brokers are shared by cluster id for the life of the process
+func newTestMemory(t *testing.T, ctx context.Context, retention time.Duration) *Memory {
+	t.Helper()
+
+	testBrokers++
+
+	m, err := NewMemory(ctx, &config.StreamConfig{ClusterID: fmt.Sprintf("%s_%d", t.Name(), testBrokers), RetentionDuration: retention}, testLog())
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	return m
+}
+
+func publishAll(t *testing.T, conn Transport, subject string, bodies ...string) {
+	t.Helper()
+
+	for _, body := range bodies {
+		err := conn.Publish(subject, []byte(body))
+		if err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+	}
+}
+
+func bodies(msgs []*Message) []string {
+	result := []string{}
+	for _, msg := range msgs {
+		result = append(result, string(msg.Data))
+	}
+
+	return result
+}
+
+func expectBodies(t *testing.T, msgs []*Message, expected ...string) {
+	t.Helper()
+
+	if fmt.Sprintf("%q", bodies(msgs)) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("expected %q got %q", expected, bodies(msgs))
+	}
+}
+
+// expectNothing fails when a message arrives within wait
+func expectNothing(t *testing.T, msgs chan *Message, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message %q", msg.Data)
+	case <-time.After(wait):
+	}
+}
+
+func TestMemoryOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, time.Hour)
+
+	publishAll(t, m, "prometheus", "one", "two", "three")
+
+	msgs := make(chan *Message, 10)
+	_, err := m.Subscribe("prometheus", SubscribeOptions{StartAt: "first"}, func(msg *Message) { msgs <- msg })
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	publishAll(t, m, "prometheus", "four")
+	publishAll(t, m, "other", "ignored")
+
+	received := receive(t, msgs, 4)
+	expectBodies(t, received, "one", "two", "three", "four")
+
+	for i, msg := range received {
+		if msg.Sequence != uint64(i+1) {
+			t.Errorf("expected sequence %d got %d", i+1, msg.Sequence)
+		}
+	}
+
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
+
+func TestMemoryDurableResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, time.Hour)
+	opts := SubscribeOptions{Durable: "receiver", StartAt: "first", ManualAck: true}
+
+	publishAll(t, m, "prometheus", "one", "two")
+
+	msgs := make(chan *Message, 10)
+	handler := func(msg *Message) {
+		msg.Ack()
+		msgs <- msg
+	}
+
+	sub, err := m.Subscribe("prometheus", opts, handler)
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	expectBodies(t, receive(t, msgs, 2), "one", "two")
+	sub.Unsubscribe()
+
+	publishAll(t, m, "prometheus", "three")
+
+	_, err = m.Subscribe("prometheus", opts, handler)
+	if err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+
+	expectBodies(t, receive(t, msgs, 1), "three")
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
+
+func TestMemoryQueueGroupSharing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, time.Hour)
+	opts := SubscribeOptions{QueueGroup: "receivers", StartAt: "first"}
+
+	first := make(chan *Message, 20)
+	second := make(chan *Message, 20)
+
+	m.Subscribe("prometheus", opts, func(msg *Message) { first <- msg })
+	m.Subscribe("prometheus", opts, func(msg *Message) { second <- msg })
+
+	for i := 0; i < 10; i++ {
+		publishAll(t, m, "prometheus", fmt.Sprintf("%d", i))
+	}
+
+	seen := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+
+	for len(seen) < 10 {
+		select {
+		case msg := <-first:
+			seen[string(msg.Data)]++
+		case msg := <-second:
+			seen[string(msg.Data)]++
+		case <-timeout:
+			t.Fatalf("received %d of 10 messages", len(seen))
+		}
+	}
+
+	expectNothing(t, first, 50*time.Millisecond)
+	expectNothing(t, second, 0)
+
+	for body, count := range seen {
+		if count != 1 {
+			t.Errorf("message %s was delivered %d times", body, count)
+		}
+	}
+}
+
+func TestMemoryRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, 50*time.Millisecond)
+
+	publishAll(t, m, "prometheus", "expired")
+	time.Sleep(100 * time.Millisecond)
+	publishAll(t, m, "prometheus", "kept")
+
+	msgs := make(chan *Message, 10)
+	m.Subscribe("prometheus", SubscribeOptions{StartAt: "first"}, func(msg *Message) { msgs <- msg })
+
+	expectBodies(t, receive(t, msgs, 1), "kept")
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
+
+func TestMemoryRedelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, time.Hour)
+
+	msgs := make(chan *Message, 10)
+	deliveries := 0
+
+	m.Subscribe("prometheus", SubscribeOptions{ManualAck: true, AckWait: 50 * time.Millisecond}, func(msg *Message) {
+		deliveries++
+
+		// only the second delivery is acknowledged
+		if deliveries > 1 {
+			msg.Ack()
+		}
+
+		msgs <- msg
+	})
+
+	publishAll(t, m, "prometheus", "one")
+
+	expectBodies(t, receive(t, msgs, 2), "one", "one")
+	expectNothing(t, msgs, 150*time.Millisecond)
+}
+
+func TestMemoryMaxInflight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestMemory(t, ctx, time.Hour)
+
+	msgs := make(chan *Message, 10)
+	m.Subscribe("prometheus", SubscribeOptions{ManualAck: true, MaxInflight: 2}, func(msg *Message) { msgs <- msg })
+
+	publishAll(t, m, "prometheus", "one", "two", "three", "four")
+
+	received := receive(t, msgs, 2)
+	expectBodies(t, received, "one", "two")
+	expectNothing(t, msgs, 50*time.Millisecond)
+
+	for _, msg := range received {
+		msg.Ack()
+	}
+
+	received = receive(t, msgs, 2)
+	expectBodies(t, received, "three", "four")
+}
+
+func TestMemoryResumeAfterShutdown(t *testing.T) {
+	testBrokers++
+
+	cfg := &config.StreamConfig{ClusterID: fmt.Sprintf("%s_%d", t.Name(), testBrokers), RetentionDuration: time.Hour}
+	opts := SubscribeOptions{Durable: "receiver", StartAt: "first", ManualAck: true}
+	msgs := make(chan *Message, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m, _ := NewMemory(ctx, cfg, testLog())
+
+	m.Subscribe("prometheus", opts, func(msg *Message) {
+		msg.Ack()
+		msgs <- msg
+	})
+
+	publishAll(t, m, "prometheus", "one")
+	expectBodies(t, receive(t, msgs, 1), "one")
+
+	// the durable outlives the transport like it would on a Stream server
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ = NewMemory(ctx, cfg, testLog())
+	publishAll(t, m, "prometheus", "two")
+
+	resumed := make(chan *Message, 10)
+	m.Subscribe("prometheus", opts, func(msg *Message) {
+		msg.Ack()
+		resumed <- msg
+	})
+
+	expectBodies(t, receive(t, resumed, 1), "two")
+	expectNothing(t, msgs, 50*time.Millisecond)
+}
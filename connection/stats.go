@@ -0,0 +1,91 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_streams_connection_connected",
+		Help: "Indicates if a supervised connection to a Stream is established",
+	}, []string{"connection"})
+
+	reconnectCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_connection_reconnects",
+		Help: "How many times a supervised connection to a Stream was lost and re-established",
+	}, []string{"connection"})
+
+	natsConnectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_streams_nats_connected",
+		Help: "Indicates if a NATS client is connected",
+	}, []string{"client"})
+
+	natsServerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_streams_nats_server_info",
+		Help: "The NATS server a client is connected to",
+	}, []string{"client", "server"})
+
+	natsReconnectCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_nats_reconnects",
+		Help: "How many times a NATS client reconnected",
+	}, []string{"client"})
+
+	natsDisconnectCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_nats_disconnects",
+		Help: "How many times a NATS client got disconnected",
+	}, []string{"client"})
+
+	natsErrorCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_nats_async_errors",
+		Help: "Asynchronous errors reported by a NATS client",
+	}, []string{"client"})
+
+	stanLostCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_stan_connection_lost",
+		Help: "How many times the NATS Streaming connection was lost",
+	}, []string{"client"})
+
+	restoreErrCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_connection_restore_errors",
+		Help: "Subscriptions that could not be restored after connecting to a Stream",
+	}, []string{"connection"})
+)
+
+func init() {
+	prometheus.MustRegister(connectedGauge)
+	prometheus.MustRegister(reconnectCtr)
+	prometheus.MustRegister(restoreErrCtr)
+	prometheus.MustRegister(natsConnectedGauge)
+	prometheus.MustRegister(natsServerGauge)
+	prometheus.MustRegister(natsReconnectCtr)
+	prometheus.MustRegister(natsDisconnectCtr)
+	prometheus.MustRegister(natsErrorCtr)
+	prometheus.MustRegister(stanLostCtr)
+}
+
+var servers = make(map[string]string)
+var serversMu sync.Mutex
+
+// natsConnected records the server a NATS client is connected to, an empty
+// server marks the client as disconnected
+func natsConnected(client string, server string) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	previous, ok := servers[client]
+	if ok {
+		natsServerGauge.DeleteLabelValues(client, previous)
+		delete(servers, client)
+	}
+
+	if server == "" {
+		natsConnectedGauge.WithLabelValues(client).Set(0)
+		return
+	}
+
+	servers[client] = server
+	natsServerGauge.WithLabelValues(client, server).Set(1)
+	natsConnectedGauge.WithLabelValues(client).Set(1)
+}
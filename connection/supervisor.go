@@ -0,0 +1,309 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNotConnected is returned when publishing through a Supervisor that is not connected
+var ErrNotConnected = errors.New("not connected")
+
+// Supervisor owns a connection to a Stream, it reconnects forever when the connection
+// is lost and restores every subscription made through it once on each new connection.
+//
+// Supervisor implements Transport so it can be used in place of a connection
+type Supervisor struct {
+	name      string
+	cfg       *config.StreamConfig
+	log       *logrus.Entry
+	conn      Transport
+	subs      []*supervisedSubscription
+	onConnect []func(Transport)
+	connected chan struct{}
+	once      sync.Once
+	running   sync.Once
+	since     time.Time
+
+	sync.Mutex
+}
+
+type supervisedSubscription struct {
+	supervisor *Supervisor
+	subject    string
+	opts       SubscribeOptions
+	handler    Handler
+	current    Subscription
+}
+
+// NewSupervisor creates a supervisor for a Stream, name identifies the connection in
+// metrics. Run has to be called to connect.  Supervisors are shared, creating one for
+// a StreamConfig that already has one returns the existing supervisor
+func NewSupervisor(name string, cfg *config.StreamConfig, log *logrus.Entry) *Supervisor {
+	supervisorsMu.Lock()
+	defer supervisorsMu.Unlock()
+
+	if s := supervisorFor(cfg); s != nil {
+		return s
+	}
+
+	connectedGauge.WithLabelValues(name).Set(0)
+
+	s := &Supervisor{
+		name:      name,
+		cfg:       cfg,
+		log:       log,
+		connected: make(chan struct{}),
+		since:     time.Now(),
+	}
+
+	supervisors = append(supervisors, s)
+
+	return s
+}
+
+// OnConnect registers a function that is called after every connection, once subscriptions are restored
+func (s *Supervisor) OnConnect(cb func(Transport)) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.onConnect = append(s.onConnect, cb)
+}
+
+// Run connects to the Stream and maintains the connection until ctx is cancelled,
+// calling Run on a shared supervisor that is already running returns immediately
+func (s *Supervisor) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	first := false
+	s.running.Do(func() { first = true })
+
+	if !first {
+		return
+	}
+
+	try := 0
+
+	for {
+		lost := make(chan error, 1)
+
+		conn, err := New(ctx, s.cfg, s.log, func(reason error) {
+			select {
+			case lost <- reason:
+			default:
+			}
+		})
+		if err == nil {
+			err = s.activate(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			try++
+			s.log.Errorf("Could not connect to the Stream: %s", err)
+
+			if backoffPolicy(s.cfg).InterruptableSleep(ctx, try) != nil {
+				return
+			}
+
+			continue
+		}
+
+		try = 0
+
+		s.Lock()
+		callbacks := append([]func(Transport){}, s.onConnect...)
+		s.Unlock()
+
+		for _, cb := range callbacks {
+			cb(s)
+		}
+
+		select {
+		case reason := <-lost:
+			s.log.Errorf("Stream connection lost, reconnecting: %s", reason)
+			reconnectCtr.WithLabelValues(s.name).Inc()
+			s.deactivate()
+			conn.Close()
+
+		case <-ctx.Done():
+			s.deactivate()
+			conn.Close()
+			return
+		}
+	}
+}
+
+// WaitConnected blocks until the first connection was made or ctx is cancelled
+func (s *Supervisor) WaitConnected(ctx context.Context) error {
+	select {
+	case <-s.connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsConnected determines if the Stream is currently connected
+func (s *Supervisor) IsConnected() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.conn != nil
+}
+
+// status reports problems with the connection and its subscriptions and how long
+// the connection has been in its current state
+func (s *Supervisor) status() (problems []string, since time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		problems = append(problems, fmt.Sprintf("%s is not connected", s.name))
+	}
+
+	for _, sub := range s.subs {
+		if sub.current == nil {
+			problems = append(problems, fmt.Sprintf("%s is not subscribed to %s", s.name, sub.subject))
+		}
+	}
+
+	return problems, time.Since(s.since)
+}
+
+// activate restores all subscriptions on a new connection and starts using it
+func (s *Supervisor) activate(conn Transport) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sub := range s.subs {
+		current, err := conn.Subscribe(sub.subject, sub.opts, sub.handler)
+		if err != nil {
+			restoreErrCtr.WithLabelValues(s.name).Inc()
+			return err
+		}
+
+		sub.current = current
+	}
+
+	s.conn = conn
+	s.since = time.Now()
+	connectedGauge.WithLabelValues(s.name).Set(1)
+	s.once.Do(func() { close(s.connected) })
+
+	return nil
+}
+
+// deactivate stops using a lost connection, its subscriptions are forgotten without
+// unsubscribing so durable subscriptions are kept on the Stream
+func (s *Supervisor) deactivate() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sub := range s.subs {
+		sub.current = nil
+	}
+
+	s.conn = nil
+	s.since = time.Now()
+	connectedGauge.WithLabelValues(s.name).Set(0)
+}
+
+func (s *Supervisor) transport() Transport {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.conn
+}
+
+// Publish implements Transport
+func (s *Supervisor) Publish(subject string, data []byte) error {
+	conn := s.transport()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return conn.Publish(subject, data)
+}
+
+// PublishAsync implements Transport
+func (s *Supervisor) PublishAsync(subject string, data []byte, ack func(err error)) error {
+	conn := s.transport()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return conn.PublishAsync(subject, data, ack)
+}
+
+// PublishRaw implements Transport
+func (s *Supervisor) PublishRaw(subject string, data []byte) error {
+	conn := s.transport()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return conn.PublishRaw(subject, data)
+}
+
+// Subscribe implements Transport, the subscription is made immediately when connected
+// and restored after every reconnection until it is unsubscribed
+func (s *Supervisor) Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	sub := &supervisedSubscription{
+		supervisor: s,
+		subject:    subject,
+		opts:       opts,
+		handler:    handler,
+	}
+
+	if s.conn != nil {
+		current, err := s.conn.Subscribe(subject, opts, handler)
+		if err != nil {
+			return nil, err
+		}
+
+		sub.current = current
+	}
+
+	s.subs = append(s.subs, sub)
+
+	return sub, nil
+}
+
+// Close implements Transport, the connection is closed when the context passed to Run is cancelled
+func (s *Supervisor) Close() {}
+
+// Unsubscribe implements Subscription
+func (sub *supervisedSubscription) Unsubscribe() error {
+	s := sub.supervisor
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i, candidate := range s.subs {
+		if candidate == sub {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			break
+		}
+	}
+
+	if sub.current == nil {
+		return nil
+	}
+
+	return sub.current.Unsubscribe()
+}
@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/backoff"
+	"github.com/choria-io/prometheus-streams/config"
+	stan "github.com/nats-io/stan.go"
+	"github.com/sirupsen/logrus"
+)
+
+// Message is a message received from a Stream
+type Message struct {
+	Subject   string
+	Sequence  uint64
+	Timestamp time.Time
+	Data      []byte
+
+	ack func() error
+}
+
+// Ack acknowledges the message when the subscription uses manual acks
+func (m *Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+
+	return m.ack()
+}
+
+// Handler processes messages received from a Stream
+type Handler func(msg *Message)
+
+// SubscribeOptions configures a subscription, without a durable name or queue
+// group the subscription is ephemeral.  StartAt can be first or last, when no
+// start position is set only new messages are received.  The start position only
+// applies when a durable is created, an existing durable resumes where it left off
+type SubscribeOptions struct {
+	Durable       string
+	QueueGroup    string
+	StartAt       string
+	StartSequence uint64
+	StartTime     time.Time
+	ManualAck     bool
+	MaxInflight   int
+	AckWait       time.Duration
+}
+
+// Subscription is an active subscription to a Stream
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Transport is a connection to a Stream
+type Transport interface {
+	// Publish publishes data to the Stream and waits for it to be stored
+	Publish(subject string, data []byte) error
+
+	// PublishAsync publishes data to the Stream without waiting for it to be stored,
+	// ack is called once the Stream acknowledged or rejected the message
+	PublishAsync(subject string, data []byte, ack func(err error)) error
+
+	// PublishRaw publishes data without persisting it, implements lifecycle.PublishConnector
+	PublishRaw(subject string, data []byte) error
+
+	// Subscribe subscribes to a subject on the Stream
+	Subscribe(subject string, opts SubscribeOptions, handler Handler) (Subscription, error)
+
+	// Close disconnects from the Stream
+	Close()
+}
+
+// New connects to a Stream using the transport set in the configuration, lost is
+// called when the connection is lost and cannot be recovered
+func New(ctx context.Context, cfg *config.StreamConfig, log *logrus.Entry, lost func(reason error)) (Transport, error) {
+	switch cfg.Transport {
+	case "jetstream":
+		return NewJetStream(ctx, cfg, log, lost)
+
+	case "memory":
+		return NewMemory(ctx, cfg, log)
+
+	case "directory":
+		return NewDirectory(ctx, cfg, log)
+
+	case "", "stan":
+		conn, err := NewConnection(ctx, cfg, log, func(_ stan.Conn, reason error) { lost(reason) })
+		if err != nil {
+			return nil, err
+		}
+
+		// timed out, ctx cancelled etc, anyway, its dead, nothing can be done
+		if conn.Conn == nil {
+			return nil, fmt.Errorf("could not connect to the Stream, perhaps due to interrupt")
+		}
+
+		return conn, nil
+
+	default:
+		return nil, fmt.Errorf("unknown transport %s", cfg.Transport)
+	}
+}
+
+// backoffPolicy is the policy configured for the stream, FiveSec when none is set
+func backoffPolicy(cfg *config.StreamConfig) backoff.BackoffPolicy {
+	if len(cfg.BackoffPolicy.Millis) == 0 {
+		return backoff.FiveSec
+	}
+
+	return cfg.BackoffPolicy
+}
@@ -0,0 +1,290 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/sirupsen/logrus"
+)
+
+// Publisher is a connection that dead letters can be published to
+type Publisher interface {
+	Publish(target string, body []byte) error
+}
+
+// Letter is a message that could not be delivered along with the reason why
+type Letter struct {
+	Time      int64  `json:"time"`
+	Reason    string `json:"reason"`
+	Error     string `json:"error"`
+	Subject   string `json:"subject"`
+	Sequence  uint64 `json:"sequence"`
+	Publisher string `json:"publisher,omitempty"`
+	Job       string `json:"job,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Output    string `json:"output,omitempty"`
+	Data      []byte `json:"data"`
+
+	// File is the file the letter was read from, empty when not read from disk
+	File string `json:"-"`
+
+	// Position is the sequence of the letter on the dead letter topic, 0 when not read from the topic
+	Position uint64 `json:"-"`
+}
+
+// Sink stores dead letters on a topic and/or in a directory
+type Sink struct {
+	topic    string
+	dir      string
+	maxFiles int
+	conn     Publisher
+	log      *logrus.Entry
+
+	sync.Mutex
+}
+
+// New creates a new dead letter sink
+func New(cfg *config.DeadLetterConfig, log *logrus.Entry) (*Sink, error) {
+	s := &Sink{
+		topic:    cfg.Topic,
+		dir:      cfg.Directory,
+		maxFiles: cfg.MaxFiles,
+		log:      log,
+	}
+
+	if s.dir != "" {
+		err := os.MkdirAll(s.dir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("could not create dead letter directory %s: %s", s.dir, err)
+		}
+	}
+
+	return s, nil
+}
+
+// SetPublisher sets the connection used to publish dead letters to the topic
+func (s *Sink) SetPublisher(p Publisher) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.conn = p
+}
+
+// Store saves a letter to all configured destinations
+func (s *Sink) Store(l *Letter) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if l.Time == 0 {
+		l.Time = time.Now().UTC().Unix()
+	}
+
+	j, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("could not encode dead letter: %s", err)
+	}
+
+	var errs []string
+
+	if s.topic != "" {
+		if s.conn == nil {
+			errs = append(errs, "not connected")
+		} else if err = s.conn.Publish(s.topic, j); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if s.dir != "" {
+		err = s.write(j)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("could not store dead letter: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func (s *Sink) write(j []byte) error {
+	name := filepath.Join(s.dir, fmt.Sprintf("%d.json", time.Now().UnixNano()))
+	tmp := name + ".tmp"
+
+	err := ioutil.WriteFile(tmp, j, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return s.rotate()
+}
+
+func (s *Sink) rotate() error {
+	if s.maxFiles <= 0 {
+		return nil
+	}
+
+	files, err := List(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(files) <= s.maxFiles {
+		return nil
+	}
+
+	for _, f := range files[:len(files)-s.maxFiles] {
+		s.log.Warnf("Removing dead letter %s due to max_files of %d", f, s.maxFiles)
+
+		err = os.Remove(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List finds all dead letter files in a directory, oldest first
+func List(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// Read loads a dead letter from a file
+func Read(file string) (*Letter, error) {
+	j, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Letter{}
+	err = json.Unmarshal(j, l)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse dead letter %s: %s", file, err)
+	}
+
+	l.File = file
+
+	return l, nil
+}
+
+// Fetch reads the dead letters stored on a topic after sequence after, oldest first,
+// reading ends once no letter was received for idle.  Messages that are not dead
+// letters are skipped
+func Fetch(ctx context.Context, conn connection.Transport, topic string, after uint64, idle time.Duration) ([]*Letter, error) {
+	var mu sync.Mutex
+	letters := []*Letter{}
+	last := time.Now()
+
+	opts := connection.SubscribeOptions{StartAt: "first"}
+	if after > 0 {
+		opts.StartSequence = after + 1
+	}
+
+	sub, err := conn.Subscribe(topic, opts, func(msg *connection.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		last = time.Now()
+
+		if msg.Sequence <= after {
+			return
+		}
+
+		l := &Letter{}
+		if json.Unmarshal(msg.Data, l) != nil {
+			return
+		}
+
+		l.Position = msg.Sequence
+		letters = append(letters, l)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not subscribe to %s: %s", topic, err)
+	}
+	defer sub.Unsubscribe()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mu.Lock()
+			if time.Since(last) > idle {
+				result := append([]*Letter{}, letters...)
+				mu.Unlock()
+
+				sort.Slice(result, func(i, j int) bool { return result[i].Position < result[j].Position })
+
+				return result, nil
+			}
+			mu.Unlock()
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ReadProgress reads the sequence of the last letter re-injected from the dead letter
+// topic as saved by SaveProgress, 0 when nothing was re-injected yet
+func ReadProgress(file string) (uint64, error) {
+	j, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(j)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid re-inject progress in %s: %s", file, err)
+	}
+
+	return seq, nil
+}
+
+// SaveProgress records the sequence of the last letter re-injected from the dead letter topic
+func SaveProgress(file string, seq uint64) error {
+	tmp := file + ".tmp"
+
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", seq)), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package deadletter
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	log := logrus.NewEntry(logger)
+
+	conn, err := connection.NewMemory(ctx, &config.StreamConfig{ClusterID: t.Name(), RetentionDuration: time.Hour}, log)
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	sink, err := New(&config.DeadLetterConfig{Topic: "prometheus.dead_letter"}, log)
+	if err != nil {
+		t.Fatalf("could not create sink: %s", err)
+	}
+
+	sink.SetPublisher(conn)
+
+	for _, reason := range []string{"decode", "push"} {
+		err = sink.Store(&Letter{Reason: reason, Error: "failed", Data: []byte(reason)})
+		if err != nil {
+			t.Fatalf("could not store letter: %s", err)
+		}
+	}
+
+	conn.Publish("prometheus.dead_letter", []byte("not a letter"))
+
+	letters, err := Fetch(ctx, conn, "prometheus.dead_letter", 0, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 letters got %d", len(letters))
+	}
+
+	for i, reason := range []string{"decode", "push"} {
+		if letters[i].Reason != reason || string(letters[i].Data) != reason {
+			t.Errorf("unexpected letter %d: %s", i, letters[i].Reason)
+		}
+
+		if letters[i].Position != uint64(i+1) {
+			t.Errorf("expected letter %d at position %d got %d", i, i+1, letters[i].Position)
+		}
+	}
+
+	letters, err = Fetch(ctx, conn, "prometheus.dead_letter", 1, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if len(letters) != 1 || letters[0].Position != 2 {
+		t.Fatalf("expected only the letter after sequence 1 got %d letters", len(letters))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reinjected")
+
+	seq, err := ReadProgress(file)
+	if err != nil || seq != 0 {
+		t.Fatalf("expected no progress without a file got %d: %v", seq, err)
+	}
+
+	err = SaveProgress(file, 10)
+	if err != nil {
+		t.Fatalf("could not save progress: %s", err)
+	}
+
+	seq, err = ReadProgress(file)
+	if err != nil || seq != 10 {
+		t.Fatalf("expected progress 10 got %d: %v", seq, err)
+	}
+
+	ioutil.WriteFile(file, []byte("garbage"), 0600)
+
+	_, err = ReadProgress(file)
+	if err == nil {
+		t.Fatalf("invalid progress was accepted")
+	}
+}
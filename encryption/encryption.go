@@ -0,0 +1,282 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+// Sealed is encrypted data along with what is needed to decrypt it
+type Sealed struct {
+	KeyID        string
+	EncryptedKey []byte
+	Nonce        []byte
+	Data         []byte
+}
+
+// Keyring holds the keys used to encrypt and decrypt scrapes, the first key
+// is used for encryption while any key can be used for decryption
+type Keyring struct {
+	keys []*key
+}
+
+type key struct {
+	id      string
+	shared  []byte
+	public  *rsa.PublicKey
+	private *rsa.PrivateKey
+}
+
+// New loads all the keys in the configuration
+func New(cfg *config.EncryptionConfig) (*Keyring, error) {
+	k := &Keyring{}
+
+	for _, kcfg := range cfg.Keys {
+		loaded, err := loadKey(kcfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not load encryption key %s: %s", kcfg.ID, err)
+		}
+
+		k.keys = append(k.keys, loaded)
+	}
+
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption keys configured")
+	}
+
+	return k, nil
+}
+
+// CanSeal determines if the first key can be used to encrypt data
+func (k *Keyring) CanSeal() bool {
+	return k.keys[0].shared != nil || k.keys[0].public != nil
+}
+
+// Seal encrypts data using the first key, when it is a public key a random
+// data key is encrypted using it and included in the result
+func (k *Keyring) Seal(data []byte) (*Sealed, error) {
+	key := k.keys[0]
+	sealed := &Sealed{KeyID: key.id}
+
+	dkey := key.shared
+
+	if dkey == nil {
+		if key.public == nil {
+			return nil, fmt.Errorf("key %s has no shared or public key to encrypt with", key.id)
+		}
+
+		dkey = make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, dkey)
+		if err != nil {
+			return nil, fmt.Errorf("could not create data key: %s", err)
+		}
+
+		sealed.EncryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key.public, dkey, []byte(key.id))
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt data key using key %s: %s", key.id, err)
+		}
+	}
+
+	gcm, err := newGCM(dkey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed.Nonce = make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, sealed.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("could not create nonce: %s", err)
+	}
+
+	sealed.Data = gcm.Seal(nil, sealed.Nonce, data, []byte(key.id))
+
+	return sealed, nil
+}
+
+// Open decrypts data using the key it was encrypted with
+func (k *Keyring) Open(sealed *Sealed) ([]byte, error) {
+	var key *key
+
+	for _, candidate := range k.keys {
+		if candidate.id == sealed.KeyID {
+			key = candidate
+			break
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("data was encrypted with key %s which is not configured", sealed.KeyID)
+	}
+
+	dkey := key.shared
+
+	if len(sealed.EncryptedKey) > 0 {
+		if key.private == nil {
+			return nil, fmt.Errorf("data was encrypted with the public part of key %s but no private key is configured for it", key.id)
+		}
+
+		var err error
+		dkey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key.private, sealed.EncryptedKey, []byte(key.id))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt data key using key %s: %s", key.id, err)
+		}
+	} else if dkey == nil {
+		return nil, fmt.Errorf("data was encrypted with the shared key %s but no shared key is configured for it", key.id)
+	}
+
+	gcm, err := newGCM(dkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size %d", len(sealed.Nonce))
+	}
+
+	data, err := gcm.Open(nil, sealed.Nonce, sealed.Data, []byte(key.id))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt data using key %s, the key is wrong or the data was modified: %s", key.id, err)
+	}
+
+	return data, nil
+}
+
+func newGCM(dkey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dkey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %s", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func loadKey(kcfg *config.EncryptionKey) (*key, error) {
+	k := &key{id: kcfg.ID}
+	var err error
+
+	if kcfg.SharedKeyFile != "" {
+		k.shared, err = loadSharedKey(kcfg.SharedKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if kcfg.PublicKeyFile != "" {
+		k.public, err = loadPublicKey(kcfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if kcfg.PrivateKeyFile != "" {
+		k.private, err = loadPrivateKey(kcfg.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// loadSharedKey reads a 32 byte key stored either hex encoded or raw
+func loadSharedKey(file string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err == nil && len(k) == 32 {
+		return k, nil
+	}
+
+	if len(raw) == 32 {
+		return raw, nil
+	}
+
+	return nil, fmt.Errorf("%s does not hold a 32 byte key", file)
+}
+
+func loadPublicKey(file string) (*rsa.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub interface{}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		pub = cert.PublicKey
+
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+
+	default:
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rpub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold a RSA public key", file)
+	}
+
+	return rpub, nil
+}
+
+func loadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rpk, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold a RSA private key", file)
+	}
+
+	return rpk, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain PEM data", file)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+// testKeys writes keys to a temporary directory for use in keyrings
+type testKeys struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	return &testKeys{t: t, dir: t.TempDir()}
+}
+
+func (k *testKeys) write(name string, data []byte) string {
+	k.t.Helper()
+
+	file := filepath.Join(k.dir, name)
+
+	err := ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		k.t.Fatalf("could not write %s: %s", name, err)
+	}
+
+	return file
+}
+
+// shared writes a hex encoded random shared key
+func (k *testKeys) shared(name string) string {
+	k.t.Helper()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return k.write(name, []byte(hex.EncodeToString(key)+"\n"))
+}
+
+// rsa writes a private key and its public key, returning the files
+func (k *testKeys) rsa(name string) (public string, private string) {
+	k.t.Helper()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		k.t.Fatalf("could not generate key: %s", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&pk.PublicKey)
+	if err != nil {
+		k.t.Fatalf("could not encode public key: %s", err)
+	}
+
+	public = k.write(name+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	private = k.write(name+".pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)}))
+
+	return public, private
+}
+
+func keyring(t *testing.T, keys ...*config.EncryptionKey) *Keyring {
+	t.Helper()
+
+	k, err := New(&config.EncryptionConfig{Keys: keys})
+	if err != nil {
+		t.Fatalf("could not load keyring: %s", err)
+	}
+
+	return k
+}
+
+func TestSealOpen(t *testing.T) {
+	keys := newTestKeys(t)
+
+	shared := keys.shared("shared")
+	otherShared := keys.shared("other_shared")
+	public, private := keys.rsa("rsa")
+	_, otherPrivate := keys.rsa("other_rsa")
+
+	cases := []struct {
+		name    string
+		sealer  *Keyring
+		opener  *Keyring
+		tamper  func(s *Sealed)
+		success bool
+	}{
+		{
+			name:    "shared key",
+			sealer:  keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener:  keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			success: true,
+		},
+		{
+			name:    "public key",
+			sealer:  keyring(t, &config.EncryptionKey{ID: "one", PublicKeyFile: public}),
+			opener:  keyring(t, &config.EncryptionKey{ID: "one", PrivateKeyFile: private}),
+			success: true,
+		},
+		{
+			name:    "rotated key",
+			sealer:  keyring(t, &config.EncryptionKey{ID: "old", SharedKeyFile: shared}),
+			opener:  keyring(t, &config.EncryptionKey{ID: "new", SharedKeyFile: otherShared}, &config.EncryptionKey{ID: "old", SharedKeyFile: shared}),
+			success: true,
+		},
+		{
+			name:   "wrong shared key",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: otherShared}),
+		},
+		{
+			name:   "wrong private key",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", PublicKeyFile: public}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", PrivateKeyFile: otherPrivate}),
+		},
+		{
+			name:   "public key only",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", PublicKeyFile: public}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", PublicKeyFile: public}),
+		},
+		{
+			name:   "shared key for public key data",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", PublicKeyFile: public}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+		},
+		{
+			name:   "unknown key",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener: keyring(t, &config.EncryptionKey{ID: "two", SharedKeyFile: shared}),
+		},
+		{
+			name:   "tampered data",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			tamper: func(s *Sealed) { s.Data[0] ^= 0xff },
+		},
+		{
+			name:   "tampered nonce",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			tamper: func(s *Sealed) { s.Nonce = s.Nonce[1:] },
+		},
+		{
+			name:   "key id swapped to another key with the same secret",
+			sealer: keyring(t, &config.EncryptionKey{ID: "one", SharedKeyFile: shared}),
+			opener: keyring(t, &config.EncryptionKey{ID: "two", SharedKeyFile: shared}),
+			tamper: func(s *Sealed) { s.KeyID = "two" },
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := []byte("up 1\n")
+
+			sealed, err := c.sealer.Seal(data)
+			if err != nil {
+				t.Fatalf("could not seal: %s", err)
+			}
+
+			if bytes.Contains(sealed.Data, data) {
+				t.Fatalf("sealed data holds the plain text")
+			}
+
+			if c.tamper != nil {
+				c.tamper(sealed)
+			}
+
+			opened, err := c.opener.Open(sealed)
+
+			if c.success {
+				if err != nil {
+					t.Fatalf("could not open: %s", err)
+				}
+
+				if !bytes.Equal(opened, data) {
+					t.Fatalf("opened %q expected %q", opened, data)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("opening succeeded with %q", opened)
+			}
+		})
+	}
+}
+
+func TestSealRequiresEncryptionKey(t *testing.T) {
+	keys := newTestKeys(t)
+	_, private := keys.rsa("rsa")
+
+	k := keyring(t, &config.EncryptionKey{ID: "one", PrivateKeyFile: private})
+
+	if k.CanSeal() {
+		t.Fatalf("a private key only keyring claims it can seal")
+	}
+
+	_, err := k.Seal([]byte("up 1\n"))
+	if err == nil {
+		t.Fatalf("sealing without a shared or public key succeeded")
+	}
+}
+
+func TestLoadSharedKey(t *testing.T) {
+	keys := newTestKeys(t)
+
+	raw := make([]byte, 32)
+	rand.Read(raw)
+
+	cases := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{name: "hex", data: []byte(hex.EncodeToString(raw) + "\n"), valid: true},
+		{name: "raw", data: raw, valid: true},
+		{name: "short hex", data: []byte(hex.EncodeToString(raw[:20])), valid: false},
+		{name: "short raw", data: raw[:16], valid: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := New(&config.EncryptionConfig{Keys: []*config.EncryptionKey{{ID: "one", SharedKeyFile: keys.write(c.name, c.data)}}})
+
+			if c.valid && err != nil {
+				t.Fatalf("valid key was rejected: %s", err)
+			}
+
+			if !c.valid && err == nil {
+				t.Fatalf("invalid key was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package receiver
+
+import (
+	"github.com/choria-io/prometheus-streams/deadletter"
+	"github.com/choria-io/prometheus-streams/scrape"
+)
+
+func (r *Receiver) setupDeadLetter() (err error) {
+	if r.cfg.DeadLetter == nil {
+		return nil
+	}
+
+	r.dlq, err = deadletter.New(r.cfg.DeadLetter, r.cfg.Log("deadletter"))
+
+	return err
+}
+
+// deadLetter stores a message that could not be delivered, data is the message as
+// received from the stream so it is stored still signed and encrypted
+func (r *Receiver) deadLetter(reason string, failure error, sc *scrape.Scrape, data []byte, subject string, seq uint64, output string) {
+	if r.dlq == nil {
+		return
+	}
+
+	letter := &deadletter.Letter{
+		Reason:   reason,
+		Error:    failure.Error(),
+		Subject:  subject,
+		Sequence: seq,
+		Output:   output,
+		Data:     data,
+	}
+
+	if sc != nil {
+		letter.Publisher = sc.Publisher
+		letter.Job = sc.Job
+		letter.Instance = sc.Instance
+	}
+
+	err := r.dlq.Store(letter)
+	if err != nil {
+		r.log.Errorf("Could not store dead letter: %s", err)
+		deadLetterErrCtr.Inc()
+		return
+	}
+
+	deadLetterCtr.WithLabelValues(reason).Inc()
+}
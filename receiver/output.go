@@ -0,0 +1,249 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/backoff"
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/choria-io/prometheus-streams/scrape"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// push is a decompressed scrape waiting to be pushed to an output, data is the
+// message as received from the stream
+type push struct {
+	scrape   scrape.Scrape
+	body     []byte
+	data     []byte
+	subject  string
+	sequence uint64
+}
+
+// output pushes scrapes to a single Push Gateway using a pool of workers, each
+// output has its own queues and retries so a failing output does not hold up others
+type output struct {
+	receiver *Receiver
+	name     string
+	url      string
+	retries  int
+	label    bool
+	timeout  time.Duration
+	inboxes  []chan push
+	wait     <-chan struct{}
+	client   *http.Client
+	pending  sync.WaitGroup
+}
+
+// startOutputs starts the configured number of posters for every output
+func (r *Receiver) startOutputs(ctx context.Context) {
+	r.outputs = []*output{}
+
+	for _, ocfg := range r.cfg.PushGateway.Outputs {
+		o := r.newOutput(ocfg)
+
+		for i := range o.inboxes {
+			o.inboxes[i] = make(chan push, 10)
+			go o.poster(ctx, i)
+		}
+
+		r.outputs = append(r.outputs, o)
+	}
+}
+
+func (r *Receiver) newOutput(ocfg *config.OutputConfig) *output {
+	return &output{
+		receiver: r,
+		name:     ocfg.Name,
+		url:      ocfg.URL,
+		retries:  ocfg.Retries,
+		label:    r.cfg.PushGateway.PublisherLabel,
+		timeout:  r.cfg.PushGateway.TimeoutDuration,
+		inboxes:  make([]chan push, r.cfg.PushGateway.Workers),
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:    10,
+				IdleConnTimeout: 30 * time.Second,
+			},
+		},
+	}
+}
+
+// output finds the started output called name, outputs that were not started are
+// created without posters so they can only be used to post directly
+func (r *Receiver) output(name string) (*output, error) {
+	for _, o := range r.outputs {
+		if o.name == name {
+			return o, nil
+		}
+	}
+
+	if r.cfg.PushGateway == nil {
+		return nil, fmt.Errorf("no push_gateway configured")
+	}
+
+	for _, ocfg := range r.cfg.PushGateway.Outputs {
+		if ocfg.Name == name {
+			o := r.newOutput(ocfg)
+			r.outputs = append(r.outputs, o)
+
+			return o, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown output %s", name)
+}
+
+// route sends a scrape to a poster chosen by the job and instance so that
+// scrapes for the same group are always pushed in the order they arrived,
+// when the poster is backed up the scrape is dead lettered for this output
+// so that other outputs keep receiving scrapes, see waitFor
+func (o *output) route(sc scrape.Scrape, body []byte, msg *connection.Message) {
+	h := fnv.New32a()
+	h.Write([]byte(sc.Job + "/" + sc.Instance))
+	worker := int(h.Sum32() % uint32(len(o.inboxes)))
+
+	o.pending.Add(1)
+
+	p := push{scrape: sc, body: body, data: msg.Data, subject: msg.Subject, sequence: msg.Sequence}
+
+	select {
+	case o.inboxes[worker] <- p:
+	default:
+		if !o.waitFor(worker, p) {
+			o.pending.Done()
+			return
+		}
+	}
+
+	queueGauge.WithLabelValues(o.name, strconv.Itoa(worker)).Set(float64(len(o.inboxes[worker])))
+}
+
+// waitFor queues a push once the full queue of worker has room when the output
+// waits rather than overflows, outputs that do not wait dead letter the push
+func (o *output) waitFor(worker int, p push) bool {
+	if o.wait != nil {
+		select {
+		case o.inboxes[worker] <- p:
+			return true
+		case <-o.wait:
+			return false
+		}
+	}
+
+	o.receiver.log.Errorf("Output %s is backed up, dead lettering scrape for %s/%s", o.name, p.scrape.Job, p.scrape.Instance)
+	outputOverflowCtr.WithLabelValues(o.name).Inc()
+	o.receiver.deadLetter("overflow", fmt.Errorf("output %s queue is full", o.name), &p.scrape, p.data, p.subject, p.sequence, o.name)
+
+	return false
+}
+
+// waitOutputs waits for all scrapes routed to any output to be pushed
+func (r *Receiver) waitOutputs() {
+	for _, o := range r.outputs {
+		o.pending.Wait()
+	}
+}
+
+func (o *output) poster(ctx context.Context, worker int) {
+	inbox := o.inboxes[worker]
+
+	for {
+		select {
+		case p := <-inbox:
+			queueGauge.WithLabelValues(o.name, strconv.Itoa(worker)).Set(float64(len(inbox)))
+			o.publish(ctx, p)
+			o.pending.Done()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (o *output) publish(ctx context.Context, p push) {
+	obs := prometheus.NewTimer(publishTime)
+	defer obs.ObserveDuration()
+
+	sc := p.scrape
+
+	target := o.target(&sc)
+
+	try := 0
+
+	for {
+		err := o.post(ctx, sc.Method, target, p.body)
+		if err == nil {
+			o.receiver.log.Debugf("Posted %d bytes to %s", len(p.body), target)
+			return
+		}
+
+		o.receiver.log.Errorf("Posting to %s failed: %s", target, err)
+		errorCtr.WithLabelValues(sc.Job).Inc()
+		outputErrorCtr.WithLabelValues(o.name).Inc()
+
+		if try >= o.retries {
+			o.receiver.deadLetter("push", err, &sc, p.data, p.subject, p.sequence, o.name)
+			return
+		}
+
+		try++
+		outputRetryCtr.WithLabelValues(o.name).Inc()
+
+		if backoff.FiveSec.InterruptableSleep(ctx, try) != nil {
+			return
+		}
+	}
+}
+
+// target is the Push Gateway url for the group of a scrape
+func (o *output) target(sc *scrape.Scrape) string {
+	return fmt.Sprintf("%s/metrics%s", o.url, sc.GroupingPath(o.label))
+}
+
+// post pushes body to target using method, defaulting to POST
+func (o *output) post(ctx context.Context, method string, target string, body []byte) error {
+	timeout, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		return fmt.Errorf("unsupported push method %s", method)
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if method != http.MethodDelete {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	resp, err := ctxhttp.Do(timeout, o.client, req)
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 202 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	return nil
+}
@@ -6,206 +6,373 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
-	"net/http"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/choria-io/go-lifecycle"
+	security "github.com/choria-io/go-security"
 
+	"github.com/choria-io/prometheus-streams/acl"
 	"github.com/choria-io/prometheus-streams/circuitbreaker"
 
 	"github.com/choria-io/prometheus-streams/build"
 	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/choria-io/prometheus-streams/deadletter"
+	"github.com/choria-io/prometheus-streams/encryption"
 	"github.com/choria-io/prometheus-streams/scrape"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/choria-io/prometheus-streams/config"
-	"github.com/nats-io/go-nats-streaming"
 )
 
-var inbox = make(chan scrape.Scrape, 10)
-var restart = make(chan struct{})
-var maxAge int64
-var err error
-var conn *connection.Connection
-var log *logrus.Entry
-
-// Pausable is the circuit breaker for the receiver
+// Pausable is the circuit breaker of the receiver started by Run
 var Pausable *circuitbreaker.Pausable
 
+// Receiver consumes scrapes from the receiver stream and pushes them to the outputs
+type Receiver struct {
+	cfg              *config.Config
+	log              *logrus.Entry
+	conn             connection.Transport
+	outputs          []*output
+	dlq              *deadletter.Sink
+	acls             *acl.ACL
+	verifier         security.Provider
+	requireSigned    bool
+	keyring          *encryption.Keyring
+	requireEncrypted bool
+	maxAge           int64
+
+	// Pausable is the circuit breaker for the receiver
+	Pausable *circuitbreaker.Pausable
+}
+
+// Run receives from a supervised connection to the receiver stream until ctx is cancelled
 func Run(ctx context.Context, wg *sync.WaitGroup, cfg *config.Config) {
 	defer wg.Done()
 
-	log = cfg.Log("receiver")
-	maxAge = cfg.MaxAge
-	Pausable = circuitbreaker.New(pauseGauge)
+	log := cfg.Log("receiver")
 
-	err = connect(ctx, cfg)
+	r, err := New(cfg, connection.NewSupervisor("receiver", cfg.ReceiverStream, cfg.Log("connector")))
 	if err != nil {
-		log.Errorf("Could not connect: %s", err)
+		log.Errorf("Could not start receiver: %s", err)
 		return
 	}
 
+	Pausable = r.Pausable
+
 	log.Infof("Choria Prometheus Streams Receiver version %s starting with configuration file %s", build.Version, cfg.ConfigFile)
 
-	opts := []stan.SubscriptionOption{
-		stan.DurableName(cfg.ReceiverStream.ClientID),
-		stan.DeliverAllAvailable(),
-		stan.SetManualAckMode(),
-		stan.MaxInflight(10),
+	err = r.Run(ctx, wg)
+	if err != nil {
+		log.Errorf("Could not start receiver: %s", err)
 	}
+}
 
-	conn.Conn.Subscribe(cfg.ReceiverStream.Topic, handler, opts...)
+// New creates a receiver that consumes the receiver stream using conn, a supervised
+// connection is run by the receiver
+func New(cfg *config.Config, conn connection.Transport) (*Receiver, error) {
+	r := &Receiver{
+		cfg:      cfg,
+		log:      cfg.Log("receiver"),
+		conn:     conn,
+		maxAge:   cfg.MaxAge,
+		Pausable: circuitbreaker.New(pauseGauge),
+	}
 
-	go poster(cfg)
+	err := r.setupDeadLetter()
+	if err != nil {
+		return nil, fmt.Errorf("could not set up dead letters: %s", err)
+	}
 
-	select {
-	case <-restart:
-		conn.Close()
-		err = connect(ctx, cfg)
-		if err != nil {
-			log.Errorf("Could not connect: %s", err)
-			return
-		}
+	err = r.setupACL()
+	if err != nil {
+		return nil, fmt.Errorf("could not set up ACLs: %s", err)
+	}
 
-	case <-ctx.Done():
-		conn.Conn.Close()
+	err = r.setupVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("could not set up signature verification: %s", err)
 	}
-}
 
-func connect(ctx context.Context, cfg *config.Config) error {
-	conn, err = connection.NewConnection(ctx, cfg.ReceiverStream, cfg.Log("connector"), func(_ stan.Conn, reason error) {
-		errorCtr.WithLabelValues("unknown").Inc()
-		log.Errorf("Stream connection disconnected, initiating reconnection: %s", reason)
-		restart <- struct{}{}
-	})
+	err = r.setupKeyring()
 	if err != nil {
-		return fmt.Errorf("could not set up middleware connection: %s", err)
+		return nil, fmt.Errorf("could not set up decryption: %s", err)
 	}
 
-	// timed out, ctx cancelled etc, anyway, its dead, nothing can be done
-	if conn.Conn == nil {
-		return fmt.Errorf("could not set up middleware connection, perhaps due to interrupt")
+	if r.dlq != nil {
+		r.dlq.SetPublisher(conn)
 	}
 
-	log.Infof("Choria Prometheus Streams Receiver version %s starting with configuration file %s", build.Version, cfg.ConfigFile)
+	return r, nil
+}
 
-	event, err := lifecycle.New(lifecycle.Startup, lifecycle.Identity(cfg.Hostname), lifecycle.Component("prometheus_streams_receiver"), lifecycle.Version(build.Version))
-	if err != nil {
-		log.Errorf("Could not create startup lifecycle event: %s", err)
+// Run subscribes to the receiver stream and pushes scrapes to the outputs until ctx is cancelled
+func (r *Receiver) Run(ctx context.Context, wg *sync.WaitGroup) error {
+	r.startOutputs(ctx)
+
+	supervisor, supervised := r.conn.(*connection.Supervisor)
+	if supervised {
+		supervisor.OnConnect(r.announce)
+	} else {
+		r.announce(r.conn)
 	}
 
-	if event != nil {
-		err = lifecycle.PublishEvent(event, conn)
-		if err != nil {
-			log.Errorf("Could not publish lifecycle event: %s", err)
-		}
+	// subscriptions are made once connected and restored by the supervisor after reconnects
+	err := r.subscribe()
+	if err != nil {
+		return fmt.Errorf("could not subscribe: %s", err)
 	}
 
-	opts := []stan.SubscriptionOption{
-		stan.DurableName(cfg.ReceiverStream.ClientID),
-		stan.DeliverAllAvailable(),
-		stan.SetManualAckMode(),
-		stan.MaxInflight(10),
+	if supervised {
+		wg.Add(1)
+		go supervisor.Run(ctx, wg)
 	}
 
-	conn.Conn.Subscribe(cfg.ReceiverStream.Topic, handler, opts...)
+	<-ctx.Done()
 
 	return nil
 }
 
-func poster(cfg *config.Config) {
-	tr := &http.Transport{
-		MaxIdleConns:    10,
-		IdleConnTimeout: 30 * time.Second,
+// announce publishes a startup lifecycle event after every connection
+func (r *Receiver) announce(c connection.Transport) {
+	event, err := lifecycle.New(lifecycle.Startup, lifecycle.Identity(r.cfg.Hostname), lifecycle.Component("prometheus_streams_receiver"), lifecycle.Version(build.Version))
+	if err != nil {
+		r.log.Errorf("Could not create startup lifecycle event: %s", err)
+		return
 	}
 
-	client := &http.Client{Transport: tr}
+	err = lifecycle.PublishEvent(event, c)
+	if err != nil {
+		r.log.Errorf("Could not publish lifecycle event: %s", err)
+	}
+}
 
-	publisher := func(sc scrape.Scrape) {
-		obs := prometheus.NewTimer(publishTime)
-		defer obs.ObserveDuration()
+// subscribe creates a durable subscription named after the client id or, when a
+// queue group is configured, a durable queue subscription shared by all receivers
+// in the group, when subscribing to several subjects each gets its own durable
+func (r *Receiver) subscribe() error {
+	rcfg := r.cfg.ReceiverStream
+	subjects := rcfg.Subjects()
+
+	for _, subject := range subjects {
+		opts := subscribeOptions(rcfg)
+		opts.ManualAck = true
+		opts.MaxInflight = rcfg.MaxInflight
+		opts.AckWait = rcfg.AckWaitDuration
+		opts.Durable = rcfg.ClientID
+
+		if rcfg.QueueGroup != "" {
+			opts.Durable = rcfg.QueueGroup
+			opts.QueueGroup = rcfg.QueueGroup
+		}
 
-		var target string
+		if len(subjects) > 1 {
+			opts.Durable = subjectDurable(opts.Durable, subject)
+		}
 
-		if cfg.PushGateway.PublisherLabel {
-			target = fmt.Sprintf("%s/metrics/job/%s/instance/%s/publisher/%s", cfg.PushGateway.URL, sc.Job, sc.Instance, sc.Publisher)
+		if rcfg.QueueGroup != "" {
+			r.log.Infof("Subscribing to %s in queue group %s", subject, rcfg.QueueGroup)
 		} else {
-			target = fmt.Sprintf("%s/metrics/job/%s/instance/%s", cfg.PushGateway.URL, sc.Job, sc.Instance)
+			r.log.Infof("Subscribing to %s", subject)
 		}
 
-		body, err := uncompress(sc.Scrape)
+		_, err := r.conn.Subscribe(subject, opts, r.handler)
 		if err != nil {
-			log.Errorf("Could not uncompress scrape: %s", err)
-			errorCtr.WithLabelValues(sc.Job).Inc()
-			return
+			return fmt.Errorf("could not subscribe to %s: %s", subject, err)
 		}
+	}
 
-		resp, err := client.Post(target, "text/plain", strings.NewReader(string(body)))
-		if err != nil {
-			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
-			}
+	return nil
+}
 
-			log.Errorf("Posting to %s failed: %s", target, err)
-			errorCtr.WithLabelValues(sc.Job).Inc()
-			return
-		}
+// subjectDurable is the durable name for one of several subjects, it is derived from
+// the subject so that reordering the topics does not move a durable to another subject
+func subjectDurable(name string, subject string) string {
+	h := fnv.New32a()
+	h.Write([]byte(subject))
 
-		if resp.StatusCode != 202 {
-			log.Errorf("Posting to %s failed: %s: %s", target, resp.Status, resp.Body)
-			resp.Body.Close()
-			errorCtr.WithLabelValues(sc.Job).Inc()
-			return
-		}
+	return fmt.Sprintf("%s_%08x", name, h.Sum32())
+}
+
+func (r *Receiver) setupACL() (err error) {
+	if r.cfg.ACL == nil {
+		return nil
+	}
+
+	r.acls, err = acl.New(r.cfg.ACL)
+
+	return err
+}
 
-		resp.Body.Close()
+func (r *Receiver) setupVerifier() (err error) {
+	r.requireSigned = r.cfg.RequireSigned
+
+	if r.cfg.ReceiverStream.TLS == nil {
+		return nil
+	}
+
+	r.verifier, err = r.cfg.ReceiverStream.TLS.SecurityProvider()
+
+	return err
+}
 
-		log.Debugf("Posted %d to %s: %s", len(body), target, resp.Status)
+func (r *Receiver) setupKeyring() (err error) {
+	if r.cfg.Encryption == nil {
+		return nil
 	}
 
-	for {
-		select {
-		case sc := <-inbox:
-			publisher(sc)
+	r.requireEncrypted = r.cfg.Encryption.Required
+	r.keyring, err = encryption.New(r.cfg.Encryption)
+
+	return err
+}
+
+// verified checks the signature of signed scrapes, unsigned scrapes are only
+// accepted when signatures are not required
+func (r *Receiver) verified(s *scrape.Scrape) bool {
+	if !s.Signed() {
+		if r.requireSigned {
+			r.log.Warnf("Rejecting unsigned scrape for %s/%s from %s", s.Job, s.Instance, s.Publisher)
+			signatureRejectedCtr.WithLabelValues(s.Publisher).Inc()
+			return false
 		}
+
+		return true
+	}
+
+	if r.verifier == nil {
+		r.log.Warnf("Cannot verify signed scrape for %s/%s from %s without TLS configured, rejecting", s.Job, s.Instance, s.Publisher)
+		signatureRejectedCtr.WithLabelValues(s.Publisher).Inc()
+		return false
 	}
+
+	err := s.Verify(r.verifier)
+	if err != nil {
+		r.log.Warnf("Rejecting scrape for %s/%s from %s: %s", s.Job, s.Instance, s.Publisher, err)
+		signatureRejectedCtr.WithLabelValues(s.Publisher).Inc()
+		return false
+	}
+
+	return true
 }
 
-func handler(msg *stan.Msg) {
+// subscribeOptions determines where in the stream a new subscription starts, once a
+// durable subscription exists it always resumes from where it left off
+func subscribeOptions(rcfg *config.StreamConfig) connection.SubscribeOptions {
+	opts := connection.SubscribeOptions{
+		StartAt:       rcfg.StartAt,
+		StartSequence: rcfg.StartSequence,
+	}
+
+	if rcfg.StartDelta > 0 {
+		opts.StartTime = time.Now().Add(-rcfg.StartDelta)
+	}
+
+	return opts
+}
+
+func (r *Receiver) handler(msg *connection.Message) {
 	defer msg.Ack()
 
 	msgCtr.Inc()
 
-	if Pausable.Paused() {
+	if r.Pausable.Paused() {
 		return
 	}
 
-	s := scrape.Scrape{}
+	s, body, err := r.open(msg, true)
+	if err != nil {
+		return
+	}
+
+	for _, o := range r.outputs {
+		o.route(*s, body, msg)
+	}
+}
+
+// Redeliver pushes the scrape held in a dead letter directly to the output that
+// failed to push it, the scrape is not republished so other outputs do not get it
+// again.  The scrape is verified and decrypted as usual but its age is ignored
+func (r *Receiver) Redeliver(ctx context.Context, l *deadletter.Letter) error {
+	o, err := r.output(l.Output)
+	if err != nil {
+		return err
+	}
+
+	s, body, err := r.open(&connection.Message{Subject: l.Subject, Sequence: l.Sequence, Data: l.Data}, false)
+	if err != nil {
+		return err
+	}
+
+	return o.post(ctx, s.Method, o.target(s), body)
+}
+
+// open decodes, verifies, decrypts and decompresses a message, failures are logged and
+// counted and those that could succeed later are dead lettered
+func (r *Receiver) open(msg *connection.Message, checkAge bool) (*scrape.Scrape, []byte, error) {
+	s := &scrape.Scrape{}
 
-	err := json.Unmarshal(msg.Data, &s)
+	err := json.Unmarshal(msg.Data, s)
 	if err != nil {
-		log.Errorf("handling failed: %s", err)
+		r.log.Errorf("handling failed: %s", err)
 		errorCtr.WithLabelValues("unknown").Inc()
-		return
+		r.deadLetter("decode", err, nil, msg.Data, msg.Subject, msg.Sequence, "")
+		return nil, nil, err
 	}
 
-	if maxAge > 0 {
+	if !r.verified(s) {
+		return nil, nil, fmt.Errorf("signature of scrape for %s/%s from %s was rejected", s.Job, s.Instance, s.Publisher)
+	}
+
+	if r.acls != nil && !r.acls.Allowed(s.Publisher, s.Job, s.Instance) {
+		r.log.Warnf("Rejecting scrape for %s/%s from %s due to ACLs", s.Job, s.Instance, s.Publisher)
+		rejectedCtr.WithLabelValues(s.Publisher, s.Job).Inc()
+		return nil, nil, fmt.Errorf("scrape for %s/%s from %s was rejected due to ACLs", s.Job, s.Instance, s.Publisher)
+	}
+
+	if checkAge && r.maxAge > 0 {
 		age := time.Now().UTC().Unix() - s.Timestamp
 
-		if age > maxAge {
-			log.Warnf("Found %ds old metric for %s discarding due to maxage of %d", age, s.Instance, maxAge)
+		if age > r.maxAge {
+			r.log.Warnf("Found %ds old metric for %s discarding due to maxage of %d", age, s.Instance, r.maxAge)
 			agedCtr.WithLabelValues(s.Job).Inc()
-			return
+			return nil, nil, fmt.Errorf("scrape for %s is %ds old", s.Instance, age)
 		}
 	}
 
 	instanceSeenTime.WithLabelValues(s.Publisher).Set(float64(time.Now().UTC().Unix()))
 
-	inbox <- s
+	if s.Encrypted() {
+		if r.keyring == nil {
+			err = fmt.Errorf("scrape is encrypted with key %s but no encryption keys are configured", s.KeyID)
+		} else {
+			err = s.Decrypt(r.keyring)
+		}
+
+		if err != nil {
+			r.log.Errorf("Could not decrypt scrape for %s/%s from %s: %s", s.Job, s.Instance, s.Publisher, err)
+			decryptErrCtr.WithLabelValues(s.Publisher).Inc()
+			r.deadLetter("decrypt", err, s, msg.Data, msg.Subject, msg.Sequence, "")
+			return nil, nil, err
+		}
+	} else if r.requireEncrypted {
+		r.log.Warnf("Rejecting unencrypted scrape for %s/%s from %s", s.Job, s.Instance, s.Publisher)
+		decryptErrCtr.WithLabelValues(s.Publisher).Inc()
+		return nil, nil, fmt.Errorf("scrape for %s/%s from %s is not encrypted", s.Job, s.Instance, s.Publisher)
+	}
+
+	body, err := uncompress(s.Scrape)
+	if err != nil {
+		r.log.Errorf("Could not uncompress scrape: %s", err)
+		errorCtr.WithLabelValues(s.Job).Inc()
+		r.deadLetter("decompress", err, s, msg.Data, msg.Subject, msg.Sequence, "")
+		return nil, nil, err
+	}
+
+	return s, body, nil
 }
 
 func uncompress(data []byte) ([]byte, error) {
@@ -0,0 +1,442 @@
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/choria-io/prometheus-streams/deadletter"
+	"github.com/choria-io/prometheus-streams/scrape"
+	"github.com/sirupsen/logrus"
+)
+
+// testConfig loads yaml as a configuration file with logging discarded
+func testConfig(t *testing.T, yaml string) *config.Config {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := ioutil.WriteFile(file, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+
+	cfg, err := config.NewConfig(file)
+	if err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg.Logger = logrus.NewEntry(logger)
+
+	return cfg
+}
+
+// pushed is a request received by a test Push Gateway
+type pushed struct {
+	method string
+	path   string
+	body   string
+}
+
+// testGateway is a Push Gateway that records every push
+func testGateway(t *testing.T) (*httptest.Server, chan pushed) {
+	pushes := make(chan pushed, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes <- pushed{method: r.Method, path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, pushes
+}
+
+func testScrape(t *testing.T, job string, instance string, body string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(body))
+	gz.Close()
+
+	j, err := json.Marshal(scrape.Scrape{
+		Job:       job,
+		Instance:  instance,
+		Timestamp: time.Now().UTC().Unix(),
+		Publisher: "poller.example.net",
+		Scrape:    b.Bytes(),
+	})
+	if err != nil {
+		t.Fatalf("could not encode scrape: %s", err)
+	}
+
+	return j
+}
+
+func TestReceiverPushes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	gateway, pushes := testGateway(t)
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  cluster_id: %s
+  client_id: receiver
+  topic: prometheus
+  transport: memory
+push_gateway:
+  url: %s
+`, t.Name(), gateway.URL))
+
+	conn, err := connection.NewMemory(ctx, cfg.ReceiverStream, cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	r, err := New(cfg, conn)
+	if err != nil {
+		t.Fatalf("could not create receiver: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.Run(ctx, wg)
+	}()
+
+	err = conn.Publish("prometheus", testScrape(t, "web", "web1", "up 1\n"))
+	if err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+
+	select {
+	case p := <-pushes:
+		if p.path != "/metrics/job/web/instance/web1" {
+			t.Fatalf("pushed to unexpected group %s", p.path)
+		}
+
+		if p.body != "up 1\n" {
+			t.Fatalf("pushed unexpected body %q", p.body)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("nothing was pushed")
+	}
+}
+
+func TestReceiverPushesWithMethod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	gateway, pushes := testGateway(t)
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  cluster_id: %s
+  client_id: receiver
+  topic: prometheus
+  transport: memory
+push_gateway:
+  url: %s
+`, t.Name(), gateway.URL))
+
+	conn, err := connection.NewMemory(ctx, cfg.ReceiverStream, cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	r, err := New(cfg, conn)
+	if err != nil {
+		t.Fatalf("could not create receiver: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.Run(ctx, wg)
+	}()
+
+	cases := []struct {
+		method string
+		body   string
+		expect string
+	}{
+		{method: "", body: "up 1\n", expect: http.MethodPost},
+		{method: http.MethodPut, body: "up 1\n", expect: http.MethodPut},
+		{method: http.MethodDelete, body: "", expect: http.MethodDelete},
+	}
+
+	for _, c := range cases {
+		sc := scrape.Scrape{}
+		json.Unmarshal(testScrape(t, "batch", "node1", c.body), &sc)
+		sc.Method = c.method
+		data, _ := json.Marshal(sc)
+
+		err = conn.Publish("prometheus", data)
+		if err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+
+		select {
+		case p := <-pushes:
+			if p.method != c.expect || p.path != "/metrics/job/batch/instance/node1" || p.body != c.body {
+				t.Fatalf("expected a %s of %q got a %s of %q to %s", c.expect, c.body, p.method, p.body, p.path)
+			}
+
+		case <-time.After(10 * time.Second):
+			t.Fatalf("nothing was pushed for %s", c.expect)
+		}
+	}
+}
+
+func TestBackedUpOutputDoesNotBlockOthers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	healthy, pushes := testGateway(t)
+
+	// the broken gateway never answers so its single worker and queue fill up
+	release := make(chan struct{})
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer broken.Close()
+	defer close(release)
+
+	dir := t.TempDir()
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  cluster_id: %s
+  client_id: receiver
+  topic: prometheus
+  transport: memory
+push_gateway:
+  workers: 1
+  timeout: 1m
+  outputs:
+    - name: broken
+      url: %s
+    - name: healthy
+      url: %s
+dead_letter:
+  directory: %s
+`, t.Name(), broken.URL, healthy.URL, dir))
+
+	conn, err := connection.NewMemory(ctx, cfg.ReceiverStream, cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	r, err := New(cfg, conn)
+	if err != nil {
+		t.Fatalf("could not create receiver: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.Run(ctx, wg)
+	}()
+
+	count := 30
+
+	for i := 0; i < count; i++ {
+		err = conn.Publish("prometheus", testScrape(t, "web", fmt.Sprintf("web%d", i), "up 1\n"))
+		if err != nil {
+			t.Fatalf("publish failed: %s", err)
+		}
+
+		select {
+		case <-pushes:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("the healthy output received %d of %d scrapes", i, count)
+		}
+	}
+
+	files, _ := deadletter.List(dir)
+	if len(files) == 0 {
+		t.Fatalf("no scrapes were dead lettered for the broken output")
+	}
+
+	for _, f := range files {
+		letter, err := deadletter.Read(f)
+		if err != nil {
+			t.Fatalf("could not read dead letter: %s", err)
+		}
+
+		if letter.Reason != "overflow" || letter.Output != "broken" {
+			t.Fatalf("unexpected %s dead letter for output %s", letter.Reason, letter.Output)
+		}
+	}
+}
+
+func TestFailedPushIsDeadLettered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gateway.Close()
+
+	dir := t.TempDir()
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+receiver_stream:
+  cluster_id: %s
+  client_id: receiver
+  topic: prometheus
+  transport: memory
+push_gateway:
+  url: %s
+dead_letter:
+  directory: %s
+`, t.Name(), gateway.URL, dir))
+
+	conn, err := connection.NewMemory(ctx, cfg.ReceiverStream, cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	r, err := New(cfg, conn)
+	if err != nil {
+		t.Fatalf("could not create receiver: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.Run(ctx, wg)
+	}()
+
+	data := testScrape(t, "web", "web1", "up 1\n")
+
+	err = conn.Publish("prometheus", data)
+	if err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+
+	var files []string
+	timeout := time.After(10 * time.Second)
+
+	for len(files) == 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+			files, _ = deadletter.List(dir)
+		case <-timeout:
+			t.Fatalf("no dead letter was stored")
+		}
+	}
+
+	letter, err := deadletter.Read(files[0])
+	if err != nil {
+		t.Fatalf("could not read dead letter: %s", err)
+	}
+
+	if letter.Reason != "push" || letter.Output != "default" || letter.Sequence == 0 {
+		t.Fatalf("unexpected dead letter %s for output %s at %d", letter.Reason, letter.Output, letter.Sequence)
+	}
+
+	if !bytes.Equal(letter.Data, data) {
+		t.Fatalf("dead letter does not hold the message as published: %q", letter.Data)
+	}
+}
+
+func TestRedeliverPushesToOneOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dc2, dc2Pushes := testGateway(t)
+	dc3, dc3Pushes := testGateway(t)
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+max_age: 60
+receiver_stream:
+  topic: prometheus
+  transport: memory
+push_gateway:
+  outputs:
+    - name: dc2
+      url: %s
+    - name: dc3
+      url: %s
+`, dc2.URL, dc3.URL))
+
+	r, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("could not create receiver: %s", err)
+	}
+
+	sc := scrape.Scrape{}
+	json.Unmarshal(testScrape(t, "web", "web1", "up 1\n"), &sc)
+
+	// dead letters are often older than the max age
+	sc.Timestamp = time.Now().Add(-time.Hour).Unix()
+	data, _ := json.Marshal(sc)
+
+	err = r.Redeliver(ctx, &deadletter.Letter{Reason: "push", Output: "dc3", Subject: "prometheus", Data: data})
+	if err != nil {
+		t.Fatalf("redeliver failed: %s", err)
+	}
+
+	select {
+	case p := <-dc3Pushes:
+		if p.path != "/metrics/job/web/instance/web1" || p.body != "up 1\n" {
+			t.Fatalf("unexpected push to %s: %q", p.path, p.body)
+		}
+	default:
+		t.Fatalf("nothing was pushed to the output that failed")
+	}
+
+	expectNoPush(t, dc2Pushes)
+
+	err = r.Redeliver(ctx, &deadletter.Letter{Reason: "push", Output: "dc4", Data: data})
+	if err == nil {
+		t.Fatalf("redelivering to an unknown output succeeded")
+	}
+}
+
+func expectNoPush(t *testing.T, pushes chan pushed) {
+	t.Helper()
+
+	select {
+	case p := <-pushes:
+		t.Fatalf("unexpected push to %s", p.path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,151 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+)
+
+// Replay reads messages published between start and end from the receiver stream
+// and pushes them through the normal receiver pipeline.  Replay ends once a message
+// newer than end is seen on every subject or no messages were received for idle.
+func Replay(ctx context.Context, cfg *config.Config, start time.Time, end time.Time, idle time.Duration, ignoreAge bool) error {
+	log := cfg.Log("replay")
+
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	scfg := *cfg.ReceiverStream
+	scfg.ClientID = ""
+
+	conn, err := connection.New(rctx, &scfg, cfg.Log("connector"), func(reason error) {
+		log.Errorf("Stream connection lost during replay: %s", reason)
+		cancel()
+	})
+	if err != nil {
+		return fmt.Errorf("could not set up middleware connection: %s", err)
+	}
+	defer conn.Close()
+
+	r, err := New(cfg, conn)
+	if err != nil {
+		return err
+	}
+
+	r.log = log
+
+	if ignoreAge {
+		r.maxAge = 0
+	}
+
+	r.startOutputs(rctx)
+
+	// replayed history arrives faster than it can be pushed, wait for the outputs
+	// rather than dead lettering everything that does not fit in their queues
+	for _, o := range r.outputs {
+		o.wait = rctx.Done()
+	}
+
+	var mu sync.Mutex
+	var done bool
+	count := 0
+	last := time.Now()
+
+	finished := make(chan struct{})
+	finish := func() {
+		if !done {
+			done = true
+			close(finished)
+		}
+	}
+
+	subjects := scfg.Subjects()
+	ended := make(map[string]bool)
+
+	log.Infof("Replaying %s from %s until %s", strings.Join(subjects, ", "), start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	opts := connection.SubscribeOptions{
+		StartTime:   start,
+		ManualAck:   true,
+		MaxInflight: scfg.MaxInflight,
+		AckWait:     scfg.AckWaitDuration,
+	}
+
+	for _, subject := range subjects {
+		subject := subject
+
+		sub, err := conn.Subscribe(subject, opts, func(msg *connection.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if done || ended[subject] {
+				msg.Ack()
+				return
+			}
+
+			last = time.Now()
+
+			// each subscription ends on its own, replay is done once all have
+			if msg.Timestamp.After(end) {
+				msg.Ack()
+				ended[subject] = true
+
+				if len(ended) == len(subjects) {
+					finish()
+				}
+
+				return
+			}
+
+			count++
+			r.handler(msg)
+		})
+		if err != nil {
+			return fmt.Errorf("could not subscribe to %s: %s", subject, err)
+		}
+		defer sub.Unsubscribe()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-finished:
+		case <-ticker.C:
+			mu.Lock()
+			if time.Since(last) > idle {
+				finish()
+			}
+			mu.Unlock()
+			continue
+		case <-rctx.Done():
+			return fmt.Errorf("replay interrupted after %d messages", count)
+		}
+
+		break
+	}
+
+	log.Infof("Waiting for %d replayed messages to be pushed", count)
+
+	drained := make(chan struct{})
+	go func() {
+		r.waitOutputs()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-rctx.Done():
+		return fmt.Errorf("replay interrupted while pushing %d messages", count)
+	}
+
+	log.Infof("Replayed %d messages", count)
+
+	return nil
+}
@@ -35,6 +35,51 @@ var (
 		Help: "How long it takes to publish to Push Gateway",
 	})
 
+	deadLetterCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_dead_letters",
+		Help: "Messages that could not be delivered and were stored as dead letters",
+	}, []string{"reason"})
+
+	deadLetterErrCtr = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_dead_letter_errors",
+		Help: "Errors encountered while storing dead letters",
+	})
+
+	queueGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_streams_receiver_queue_depth",
+		Help: "How many scrapes are waiting to be pushed by each poster",
+	}, []string{"output", "worker"})
+
+	outputErrorCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_output_errors",
+		Help: "Errors encountered while pushing to a specific output",
+	}, []string{"output"})
+
+	outputOverflowCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_output_overflows",
+		Help: "Scrapes not queued for a specific output because its queue was full",
+	}, []string{"output"})
+
+	outputRetryCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_output_retries",
+		Help: "Pushes to a specific output that were retried",
+	}, []string{"output"})
+
+	rejectedCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_acl_rejected",
+		Help: "Messages that were rejected by the ACLs",
+	}, []string{"publisher", "receiver_job"})
+
+	signatureRejectedCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_signature_rejected",
+		Help: "Messages that were rejected due to missing or invalid signatures",
+	}, []string{"publisher"})
+
+	decryptErrCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_receiver_decrypt_errors",
+		Help: "Messages that could not be decrypted or were rejected for not being encrypted",
+	}, []string{"publisher"})
+
 	instanceSeenTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "prometheus_streams_receiver_seen_time",
 		Help: "When last data for a specific job and instance was received",
@@ -49,4 +94,13 @@ func init() {
 	prometheus.MustRegister(publishTime)
 	prometheus.MustRegister(msgCtr)
 	prometheus.MustRegister(instanceSeenTime)
+	prometheus.MustRegister(deadLetterCtr)
+	prometheus.MustRegister(deadLetterErrCtr)
+	prometheus.MustRegister(queueGauge)
+	prometheus.MustRegister(outputErrorCtr)
+	prometheus.MustRegister(outputOverflowCtr)
+	prometheus.MustRegister(outputRetryCtr)
+	prometheus.MustRegister(rejectedCtr)
+	prometheus.MustRegister(signatureRejectedCtr)
+	prometheus.MustRegister(decryptErrCtr)
 }
@@ -0,0 +1,55 @@
+package scrape
+
+import (
+	"errors"
+
+	"github.com/choria-io/prometheus-streams/encryption"
+)
+
+// Encrypt encrypts the compressed scrape using the first key in the keyring
+func (s *Scrape) Encrypt(k *encryption.Keyring) error {
+	if s.Encrypted() {
+		return errors.New("scrape is already encrypted")
+	}
+
+	sealed, err := k.Seal(s.Scrape)
+	if err != nil {
+		return err
+	}
+
+	s.KeyID = sealed.KeyID
+	s.EncryptedKey = sealed.EncryptedKey
+	s.Nonce = sealed.Nonce
+	s.Scrape = sealed.Data
+
+	return nil
+}
+
+// Encrypted determines if the scrape is encrypted
+func (s *Scrape) Encrypted() bool {
+	return s.KeyID != ""
+}
+
+// Decrypt decrypts the scrape using the key it was encrypted with
+func (s *Scrape) Decrypt(k *encryption.Keyring) error {
+	if !s.Encrypted() {
+		return nil
+	}
+
+	data, err := k.Open(&encryption.Sealed{
+		KeyID:        s.KeyID,
+		EncryptedKey: s.EncryptedKey,
+		Nonce:        s.Nonce,
+		Data:         s.Scrape,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Scrape = data
+	s.KeyID = ""
+	s.EncryptedKey = nil
+	s.Nonce = nil
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fetchExec runs the command of the target and uses its output as the scrape
+func fetchExec(ctx context.Context, jobname string, target *config.Target) ([]result, error) {
+	if target.TimeoutDuration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, target.TimeoutDuration)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, target.Command[0], target.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		execExitGauge.WithLabelValues(jobname, target.Name).Set(-1)
+		return nil, fmt.Errorf("timed out")
+	}
+
+	if err != nil {
+		code := -1
+
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				code = status.ExitStatus()
+			}
+		}
+
+		execExitGauge.WithLabelValues(jobname, target.Name).Set(float64(code))
+
+		return nil, fmt.Errorf("exited with code %d: %s: %s", code, err, strings.TrimSpace(truncate(stderr.String(), 256)))
+	}
+
+	execExitGauge.WithLabelValues(jobname, target.Name).Set(0)
+
+	var parser expfmt.TextParser
+
+	_, err = parser.TextToMetricFamilies(bytes.NewReader(stdout.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid exposition format: %s", err)
+	}
+
+	return []result{{instance: target.Name, body: stdout.Bytes()}}, nil
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	return s[:max]
+}
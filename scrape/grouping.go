@@ -0,0 +1,57 @@
+package scrape
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// GroupingPath is the Push Gateway path, without the leading /metrics, that
+// identifies the group this scrape belongs to
+func (s *Scrape) GroupingPath(publisherLabel bool) string {
+	path := "/" + pathSegment("job", s.Job)
+
+	if s.Instance != "" {
+		path = path + "/" + pathSegment("instance", s.Instance)
+	}
+
+	for _, name := range s.labelNames() {
+		if publisherLabel && name == "publisher" {
+			continue
+		}
+
+		path = path + "/" + pathSegment(name, s.Labels[name])
+	}
+
+	if publisherLabel {
+		path = path + "/" + pathSegment("publisher", s.Publisher)
+	}
+
+	return path
+}
+
+func (s *Scrape) labelNames() []string {
+	names := []string{}
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// pathSegment encodes a label for use in a Push Gateway path, values that
+// cannot be used as is are base64 encoded
+func pathSegment(name string, value string) string {
+	if value == "" {
+		return fmt.Sprintf("%s@base64/=", name)
+	}
+
+	if strings.Contains(value, "/") {
+		return fmt.Sprintf("%s@base64/%s", name, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+
+	return fmt.Sprintf("%s/%s", name, value)
+}
@@ -0,0 +1,313 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+// probeResult holds the gauges produced by a probe
+type probeResult struct {
+	success  bool
+	duration time.Duration
+	gauges   []probeGauge
+}
+
+type probeGauge struct {
+	name  string
+	help  string
+	value float64
+}
+
+func (p *probeResult) add(name string, help string, value float64) {
+	p.gauges = append(p.gauges, probeGauge{name: name, help: help, value: value})
+}
+
+// fetchProbe runs a blackbox style probe, a failing probe is not an error
+// but results in probe_success being 0
+func (p *Poller) fetchProbe(ctx context.Context, jobname string, target *config.Target) ([]result, error) {
+	if target.TimeoutDuration > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, target.TimeoutDuration)
+		defer cancel()
+	}
+
+	res := &probeResult{}
+	start := time.Now()
+
+	var err error
+
+	switch target.Probe {
+	case "http":
+		err = probeHTTP(ctx, target, res)
+	case "tcp":
+		err = probeTCP(ctx, target, res)
+	case "tls":
+		err = probeTLS(ctx, target, res)
+	case "dns":
+		err = probeDNS(ctx, target, res)
+	default:
+		return nil, fmt.Errorf("unknown probe %s", target.Probe)
+	}
+
+	res.duration = time.Since(start)
+	res.success = err == nil
+
+	if err != nil {
+		p.log.Debugf("Probe %s for job %s failed: %s", target.Name, jobname, err)
+	}
+
+	return []result{{instance: target.Name, body: res.exposition()}}, nil
+}
+
+func (p *probeResult) exposition() []byte {
+	var b bytes.Buffer
+
+	success := 0
+	if p.success {
+		success = 1
+	}
+
+	writeGauge(&b, "probe_success", "Displays whether or not the probe was a success", float64(success))
+	writeGauge(&b, "probe_duration_seconds", "Returns how long the probe took to complete in seconds", p.duration.Seconds())
+
+	for _, g := range p.gauges {
+		writeGauge(&b, g.name, g.help, g.value)
+	}
+
+	return b.Bytes()
+}
+
+func writeGauge(b *bytes.Buffer, name string, help string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(value))
+}
+
+func probeHTTP(ctx context.Context, target *config.Target, res *probeResult) error {
+	// like the tls probe the chain is verified after the request so that the
+	// expiry is reported even when the certificate is expired or self signed
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res.add("probe_http_status_code", "Response HTTP status code", float64(resp.StatusCode))
+
+	if resp.TLS != nil {
+		res.add("probe_ssl_earliest_cert_expiry", "Returns earliest SSL cert expiry date", earliestExpiry(resp.TLS))
+
+		err = verifyChain(resp.Request.URL.Hostname(), resp.TLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	res.add("probe_http_content_length", "Length of the HTTP response body", float64(len(body)))
+
+	valid := false
+	for _, status := range target.ValidStatus {
+		if resp.StatusCode == status {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if target.RegexPattern != nil {
+		matched := target.RegexPattern.Match(body)
+
+		match := 0
+		if matched {
+			match = 1
+		}
+
+		res.add("probe_http_regex_match", "Indicates if the body matched the configured regex", float64(match))
+
+		if !matched {
+			return fmt.Errorf("body does not match %s", target.Regex)
+		}
+	}
+
+	return nil
+}
+
+func probeTCP(ctx context.Context, target *config.Target, res *probeResult) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", target.Address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func probeTLS(ctx context.Context, target *config.Target, res *probeResult) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", target.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	host, _, _ := net.SplitHostPort(target.Address)
+
+	// the chain is verified after the handshake so that the expiry is reported
+	// even when the certificate is expired or otherwise invalid
+	tconn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		tconn.SetDeadline(deadline)
+	}
+
+	err = tconn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	state := tconn.ConnectionState()
+	res.add("probe_ssl_earliest_cert_expiry", "Returns earliest SSL cert expiry date", earliestExpiry(&state))
+
+	return verifyChain(host, &state)
+}
+
+// verifyChain verifies the certificates presented by the server against the system roots
+func verifyChain(host string, state *tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificates presented")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(opts)
+
+	return err
+}
+
+func probeDNS(ctx context.Context, target *config.Target, res *probeResult) error {
+	resolver := &net.Resolver{}
+
+	if target.Resolver != "" {
+		resolver.PreferGo = true
+		resolver.Dial = func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, target.Resolver)
+		}
+	}
+
+	answers := 0
+
+	switch target.RecordType {
+	case "A", "AAAA":
+		addrs, err := resolver.LookupIPAddr(ctx, target.Address)
+		if err != nil {
+			return err
+		}
+
+		for _, addr := range addrs {
+			if (addr.IP.To4() != nil) == (target.RecordType == "A") {
+				answers++
+			}
+		}
+
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, target.Address)
+		if err != nil {
+			return err
+		}
+
+		answers = cnameAnswers(target.Address, cname)
+
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, target.Address)
+		if err != nil {
+			return err
+		}
+
+		answers = len(mxs)
+
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, target.Address)
+		if err != nil {
+			return err
+		}
+
+		answers = len(nss)
+
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, target.Address)
+		if err != nil {
+			return err
+		}
+
+		answers = len(txts)
+	}
+
+	res.add("probe_dns_answer_rrs", "Returns number of entries in the answer resource record list", float64(answers))
+
+	if answers == 0 {
+		return fmt.Errorf("no %s records found for %s", target.RecordType, target.Address)
+	}
+
+	return nil
+}
+
+// cnameAnswers is 1 when name is an alias, LookupCNAME returns the queried
+// name itself for names that are not
+func cnameAnswers(name string, cname string) int {
+	if cname == "" || strings.EqualFold(strings.TrimSuffix(cname, "."), strings.TrimSuffix(name, ".")) {
+		return 0
+	}
+
+	return 1
+}
+
+func earliestExpiry(state *tls.ConnectionState) float64 {
+	earliest := time.Time{}
+
+	for _, cert := range state.PeerCertificates {
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+
+	return float64(earliest.Unix())
+}
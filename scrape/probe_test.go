@@ -0,0 +1,95 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+func probeGaugeValue(res *probeResult, name string) (float64, bool) {
+	for _, g := range res.gauges {
+		if g.name == name {
+			return g.value, true
+		}
+	}
+
+	return 0, false
+}
+
+func TestProbeHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	// httptest uses a self signed certificate that does not verify against the system roots
+	selfSigned := httptest.NewTLSServer(handler)
+	defer selfSigned.Close()
+
+	expiry := float64(selfSigned.Certificate().NotAfter.Unix())
+
+	cases := []struct {
+		name    string
+		url     string
+		success bool
+		expiry  bool
+	}{
+		{name: "plain", url: plain.URL, success: true},
+		{name: "self signed", url: selfSigned.URL, expiry: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := &probeResult{}
+
+			err := probeHTTP(context.Background(), &config.Target{URL: c.url, ValidStatus: []int{200}}, res)
+			if c.success && err != nil {
+				t.Fatalf("probe failed: %s", err)
+			}
+
+			if !c.success && err == nil {
+				t.Fatalf("probe succeeded")
+			}
+
+			status, ok := probeGaugeValue(res, "probe_http_status_code")
+			if !ok || status != 200 {
+				t.Fatalf("expected status 200 got %v", status)
+			}
+
+			got, ok := probeGaugeValue(res, "probe_ssl_earliest_cert_expiry")
+			if ok != c.expiry {
+				t.Fatalf("expected expiry reported to be %v", c.expiry)
+			}
+
+			if c.expiry && got != expiry {
+				t.Fatalf("expected expiry %v got %v", expiry, got)
+			}
+		})
+	}
+}
+
+func TestCNAMEAnswers(t *testing.T) {
+	cases := []struct {
+		name    string
+		cname   string
+		answers int
+	}{
+		{name: "www.example.net", cname: "web.example.net.", answers: 1},
+		{name: "www.example.net", cname: "www.example.net.", answers: 0},
+		{name: "www.example.net.", cname: "www.example.net.", answers: 0},
+		{name: "WWW.example.net", cname: "www.example.net.", answers: 0},
+		{name: "www.example.net", cname: "", answers: 0},
+	}
+
+	for _, c := range cases {
+		if got := cnameAnswers(c.name, c.cname); got != c.answers {
+			t.Errorf("expected %d answers for %s -> %q got %d", c.answers, c.name, c.cname, got)
+		}
+	}
+}
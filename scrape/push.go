@@ -0,0 +1,227 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pushEndpoint starts a Push Gateway compatible listener that publishes
+// pushed metrics into the stream
+func (p *Poller) pushEndpoint(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/job/", p.pushHandler)
+	mux.HandleFunc("/metrics/job@base64/", p.pushHandler)
+
+	if p.cfg.PushEndpoint.RemoteWrite {
+		mux.HandleFunc(p.cfg.PushEndpoint.RemoteWritePath, p.remoteWriteHandler)
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", p.cfg.PushEndpoint.Bind, p.cfg.PushEndpoint.Port),
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		server.Shutdown(timeout)
+	}()
+
+	p.log.Infof("Listening for pushed metrics on %s", server.Addr)
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		p.log.Errorf("Push endpoint failed: %s", err)
+	}
+}
+
+// pushHandler publishes a push into the stream along with its method so that the
+// receiver does a PUT, POST or DELETE of the same group on the central Push Gateway
+func (p *Poller) pushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "only PUT, POST and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, labels, err := parseGroupingPath(strings.TrimPrefix(r.URL.Path, "/metrics/"))
+	if err != nil {
+		pushErrCtr.WithLabelValues("unknown").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if p.Pausable.Paused() {
+		http.Error(w, "paused", http.StatusServiceUnavailable)
+		return
+	}
+
+	instance := labels["instance"]
+	delete(labels, "instance")
+
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	if r.Method == http.MethodDelete {
+		p.publishPush(w, job, result{instance: instance, labels: labels, method: r.Method})
+		return
+	}
+
+	data, err := p.readBody(w, r)
+	if err != nil {
+		p.log.Warnf("Could not read metrics pushed for job %s by %s: %s", job, r.RemoteAddr, err)
+		pushErrCtr.WithLabelValues(job).Inc()
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	families, err := decodePush(bytes.NewReader(data), expfmt.ResponseFormat(r.Header))
+	if err != nil {
+		p.log.Warnf("Could not decode metrics pushed for job %s by %s: %s", job, r.RemoteAddr, err)
+		pushErrCtr.WithLabelValues(job).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := encodeFamilies(families)
+	if err != nil {
+		pushErrCtr.WithLabelValues(job).Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.publishPush(w, job, result{instance: instance, labels: labels, method: r.Method, body: body})
+}
+
+func (p *Poller) publishPush(w http.ResponseWriter, job string, res result) {
+	err := p.enqueue(job, res)
+	if err != nil {
+		p.log.Errorf("Could not publish metrics pushed for job %s: %s", job, err)
+		pushErrCtr.WithLabelValues(job).Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pushReceivedCtr.WithLabelValues(job).Inc()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// readBody reads the request body, bodies larger than the configured max_size are rejected
+func (p *Poller) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := r.Body
+
+	if p.cfg.PushEndpoint.MaxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, p.cfg.PushEndpoint.MaxSize)
+	}
+
+	return ioutil.ReadAll(body)
+}
+
+// bodyErrorStatus is the response code for a body that could not be read
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// parseGroupingPath parses job/<job>/<label>/<value>... supporting the
+// <label>@base64/<value> encoding
+func parseGroupingPath(path string) (string, map[string]string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts)%2 != 0 {
+		return "", nil, fmt.Errorf("grouping labels must be name and value pairs")
+	}
+
+	labels := make(map[string]string)
+
+	for i := 0; i < len(parts); i += 2 {
+		name := parts[i]
+		value := parts[i+1]
+
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid base64 value for label %s: %s", name, err)
+			}
+
+			value = string(decoded)
+		}
+
+		if name == "" {
+			return "", nil, fmt.Errorf("empty label name")
+		}
+
+		if _, ok := labels[name]; ok {
+			return "", nil, fmt.Errorf("duplicate label %s", name)
+		}
+
+		// the receiver adds the publisher grouping label itself
+		if name == "publisher" {
+			return "", nil, fmt.Errorf("the publisher label is reserved")
+		}
+
+		labels[name] = value
+	}
+
+	job := labels["job"]
+	if job == "" {
+		return "", nil, fmt.Errorf("job name is required")
+	}
+
+	delete(labels, "job")
+
+	return job, labels, nil
+}
+
+func decodePush(body io.Reader, format expfmt.Format) (map[string]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+	dec := expfmt.NewDecoder(body, format)
+
+	for {
+		mf := &dto.MetricFamily{}
+
+		err := dec.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = mergeFamilies(families, map[string]*dto.MetricFamily{mf.GetName(): mf})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(families) == 0 {
+		return nil, fmt.Errorf("no metrics received")
+	}
+
+	return families, nil
+}
@@ -0,0 +1,101 @@
+package scrape
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/choria-io/prometheus-streams/circuitbreaker"
+)
+
+func TestPushHandler(t *testing.T) {
+	untyped := "# TYPE batch_last_run untyped\nbatch_last_run 1\n"
+
+	cfg := testConfig(t, `
+scrape_interval: 1m
+identity: poller.example.net
+poller_stream:
+  topic: prometheus
+  transport: memory
+push_endpoint:
+  port: 9091
+`)
+
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		instance string
+		labels   map[string]string
+		metrics  string
+	}{
+		{name: "put", method: http.MethodPut, path: "/metrics/job/batch/instance/node1", body: "batch_last_run 1\n", status: http.StatusAccepted, instance: "node1", metrics: untyped},
+		{name: "post", method: http.MethodPost, path: "/metrics/job/batch/dc/dc1", body: "batch_last_run 1\n", status: http.StatusAccepted, labels: map[string]string{"dc": "dc1"}, metrics: untyped},
+		{name: "delete", method: http.MethodDelete, path: "/metrics/job/batch/instance/node1", status: http.StatusAccepted, instance: "node1"},
+		{name: "base64 label", method: http.MethodPut, path: "/metrics/job/batch/path@base64/L3Zhci90bXA", body: "batch_last_run 1\n", status: http.StatusAccepted, labels: map[string]string{"path": "/var/tmp"}, metrics: untyped},
+		{name: "get", method: http.MethodGet, path: "/metrics/job/batch", status: http.StatusMethodNotAllowed},
+		{name: "publisher label", method: http.MethodPut, path: "/metrics/job/batch/publisher/other", body: "batch_last_run 1\n", status: http.StatusBadRequest},
+		{name: "unpaired label", method: http.MethodPut, path: "/metrics/job/batch/instance", body: "batch_last_run 1\n", status: http.StatusBadRequest},
+		{name: "invalid body", method: http.MethodPost, path: "/metrics/job/batch", body: "not metrics\n", status: http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &Poller{cfg: cfg, log: cfg.Log("poller"), outbox: make(chan Scrape, 1), Pausable: circuitbreaker.New(pauseGauge)}
+
+			w := httptest.NewRecorder()
+			p.pushHandler(w, httptest.NewRequest(c.method, c.path, bytes.NewReader([]byte(c.body))))
+
+			if w.Code != c.status {
+				t.Fatalf("expected %d got %d: %s", c.status, w.Code, w.Body.String())
+			}
+
+			if c.status != http.StatusAccepted {
+				if len(p.outbox) != 0 {
+					t.Fatalf("rejected push was published")
+				}
+
+				return
+			}
+
+			sc := <-p.outbox
+
+			if sc.Job != "batch" || sc.Instance != c.instance || sc.Method != c.method || sc.Publisher != "poller.example.net" {
+				t.Fatalf("unexpected scrape %s %s/%s from %s", sc.Method, sc.Job, sc.Instance, sc.Publisher)
+			}
+
+			if len(sc.Labels) != len(c.labels) {
+				t.Fatalf("expected labels %v got %v", c.labels, sc.Labels)
+			}
+
+			for k, v := range c.labels {
+				if sc.Labels[k] != v {
+					t.Fatalf("expected labels %v got %v", c.labels, sc.Labels)
+				}
+			}
+
+			gz, err := gzip.NewReader(bytes.NewReader(sc.Scrape))
+			if err != nil {
+				t.Fatalf("invalid compressed body: %s", err)
+			}
+
+			body, _ := ioutil.ReadAll(gz)
+			if string(body) != c.metrics {
+				t.Fatalf("expected metrics %q got %q", c.metrics, body)
+			}
+		})
+	}
+}
+
+func TestGroupingPathPublisher(t *testing.T) {
+	sc := &Scrape{Job: "batch", Instance: "node1", Publisher: "poller.example.net", Labels: map[string]string{"dc": "dc1", "publisher": "other"}}
+
+	if path := sc.GroupingPath(true); path != "/job/batch/instance/node1/dc/dc1/publisher/poller.example.net" {
+		t.Fatalf("unexpected grouping path %s", path)
+	}
+}
@@ -0,0 +1,256 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteWriteStale is how long series are published for after they were last received
+const remoteWriteStale = 5 * time.Minute
+
+// series is the newest sample seen for a unique set of labels
+type series struct {
+	name      string
+	labels    []prompb.Label
+	value     float64
+	timestamp int64
+	received  time.Time
+}
+
+// remoteWriteBuffer holds the newest sample of every series received through remote_write.
+// Prometheus shards series across concurrent requests while a push replaces all series of
+// the same names in a group, so groups are only published on an interval with all their
+// series
+type remoteWriteBuffer struct {
+	groups map[string]map[string]map[string]*series
+
+	sync.Mutex
+}
+
+func newRemoteWriteBuffer() *remoteWriteBuffer {
+	return &remoteWriteBuffer{groups: make(map[string]map[string]map[string]*series)}
+}
+
+// remoteWriteHandler accepts Prometheus remote_write requests and buffers the newest
+// sample of every series, grouped by their job and instance labels, until it is published
+func (p *Poller) remoteWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.Pausable.Paused() {
+		http.Error(w, "paused", http.StatusServiceUnavailable)
+		return
+	}
+
+	compressed, err := p.readBody(w, r)
+	if err != nil {
+		p.log.Warnf("Could not read remote write request from %s: %s", r.RemoteAddr, err)
+		remoteWriteErrCtr.Inc()
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+
+	req, err := decodeWriteRequest(compressed)
+	if err != nil {
+		p.log.Warnf("Could not decode remote write request from %s: %s", r.RemoteAddr, err)
+		remoteWriteErrCtr.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.remoteWrite.add(req, p.cfg.PushEndpoint.RemoteWriteJob, time.Now())
+
+	remoteWriteCtr.Add(float64(len(req.Timeseries)))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remoteWritePublisher publishes every group in the remote write buffer each interval,
+// groups that fail to publish are published again with newer data on the next interval
+func (p *Poller) remoteWritePublisher(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(p.cfg.PushEndpoint.RemoteWriteIntervalDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for job, jobResults := range p.remoteWrite.results(time.Now()) {
+				for _, res := range jobResults {
+					err := p.enqueue(job, res)
+					if err != nil {
+						p.log.Errorf("Could not publish remote write data for job %s: %s", job, err)
+						remoteWriteErrCtr.Inc()
+					}
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func decodeWriteRequest(compressed []byte) (*prompb.WriteRequest, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy data: %s", err)
+	}
+
+	req := &prompb.WriteRequest{}
+
+	err = proto.Unmarshal(data, req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf data: %s", err)
+	}
+
+	return req, nil
+}
+
+// add merges the series in a request into the buffer, series without a job label
+// are added to defaultJob.  The Push Gateway does not accept timestamps so only the
+// newest sample of each series is kept
+func (b *remoteWriteBuffer) add(req *prompb.WriteRequest, defaultJob string, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, ts := range req.Timeseries {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		job := defaultJob
+		instance := ""
+		s := &series{received: now}
+
+		for _, l := range ts.Labels {
+			switch l.Name {
+			case "__name__":
+				s.name = l.Value
+			case "job":
+				job = l.Value
+			case "instance":
+				instance = l.Value
+			default:
+				s.labels = append(s.labels, l)
+			}
+		}
+
+		if s.name == "" {
+			continue
+		}
+
+		for _, sample := range ts.Samples {
+			if s.timestamp == 0 || sample.Timestamp >= s.timestamp {
+				s.value = sample.Value
+				s.timestamp = sample.Timestamp
+			}
+		}
+
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].Name < s.labels[j].Name })
+
+		if b.groups[job] == nil {
+			b.groups[job] = make(map[string]map[string]*series)
+		}
+
+		if b.groups[job][instance] == nil {
+			b.groups[job][instance] = make(map[string]*series)
+		}
+
+		key := s.String()
+		if existing, ok := b.groups[job][instance][key]; ok && existing.timestamp > s.timestamp {
+			continue
+		}
+
+		b.groups[job][instance][key] = s
+	}
+}
+
+// results renders every group in the exposition format, series that were not received
+// for remoteWriteStale are dropped
+func (b *remoteWriteBuffer) results(now time.Time) map[string][]result {
+	b.Lock()
+	defer b.Unlock()
+
+	results := make(map[string][]result)
+
+	for job, instances := range b.groups {
+		for instance, set := range instances {
+			keys := []string{}
+			for k, s := range set {
+				if now.Sub(s.received) > remoteWriteStale {
+					delete(set, k)
+					continue
+				}
+
+				keys = append(keys, k)
+			}
+
+			if len(keys) == 0 {
+				delete(instances, instance)
+				continue
+			}
+
+			sort.Strings(keys)
+
+			var buf bytes.Buffer
+			for _, k := range keys {
+				fmt.Fprintf(&buf, "%s %s\n", k, formatValue(set[k].value))
+			}
+
+			results[job] = append(results[job], result{instance: instance, body: buf.Bytes()})
+		}
+
+		if len(instances) == 0 {
+			delete(b.groups, job)
+		}
+	}
+
+	return results
+}
+
+// String renders the series name and labels in the exposition format
+func (s *series) String() string {
+	if len(s.labels) == 0 {
+		return s.name
+	}
+
+	labels := []string{}
+	for _, l := range s.labels {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", l.Name, escapeLabelValue(l.Value)))
+	}
+
+	return fmt.Sprintf("%s{%s}", s.name, strings.Join(labels, ","))
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
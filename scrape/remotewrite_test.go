@@ -0,0 +1,62 @@
+package scrape
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func writeRequest(job string, instance string, name string, value float64, timestamp int64) *prompb.WriteRequest {
+	return &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: name},
+				{Name: "job", Value: job},
+				{Name: "instance", Value: instance},
+				{Name: "device", Value: "eth0"},
+			},
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		}},
+	}
+}
+
+func TestRemoteWriteBufferMergesShards(t *testing.T) {
+	b := newRemoteWriteBuffer()
+	now := time.Now()
+
+	// series of one group arrive in separate requests like Prometheus shards them
+	b.add(writeRequest("node", "web1", "node_network_up", 1, 1000), "remote_write", now)
+	b.add(writeRequest("node", "web1", "node_load1", 0.5, 1000), "remote_write", now)
+	b.add(writeRequest("node", "web1", "node_load1", 0.7, 2000), "remote_write", now)
+	b.add(writeRequest("node", "web1", "node_load1", 0.1, 500), "remote_write", now)
+
+	results := b.results(now)
+
+	if len(results["node"]) != 1 {
+		t.Fatalf("expected one scrape for node got %d", len(results["node"]))
+	}
+
+	expected := "node_load1{device=\"eth0\"} 0.7\nnode_network_up{device=\"eth0\"} 1\n"
+	if string(results["node"][0].body) != expected {
+		t.Fatalf("expected %q got %q", expected, results["node"][0].body)
+	}
+
+	if results["node"][0].instance != "web1" {
+		t.Fatalf("unexpected instance %s", results["node"][0].instance)
+	}
+
+	// series are published again on the next interval until they are stale
+	b.add(writeRequest("node", "web1", "node_load1", 0.9, 3000), "remote_write", now.Add(4*time.Minute))
+
+	results = b.results(now.Add(6 * time.Minute))
+
+	expected = "node_load1{device=\"eth0\"} 0.9\n"
+	if string(results["node"][0].body) != expected {
+		t.Fatalf("expected %q got %q", expected, results["node"][0].body)
+	}
+
+	if len(b.results(now.Add(10*time.Minute))) != 0 {
+		t.Fatalf("stale groups were not dropped")
+	}
+}
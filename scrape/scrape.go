@@ -1,74 +1,186 @@
 package scrape
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"sync"
+	"time"
 
-	lifecycle "github.com/choria-io/go-lifecycle"
+	security "github.com/choria-io/go-security"
 	"github.com/choria-io/prometheus-streams/build"
 	"github.com/choria-io/prometheus-streams/circuitbreaker"
 	"github.com/choria-io/prometheus-streams/config"
 	"github.com/choria-io/prometheus-streams/connection"
-	"github.com/nats-io/go-nats-streaming"
+	"github.com/choria-io/prometheus-streams/encryption"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
-var cfg *config.Config
-var log *logrus.Entry
-
+// Scrape is the data fetched for an instance of a job as published to the Stream
 type Scrape struct {
 	Job       string `json:"job"`
 	Instance  string `json:"instance"`
 	Timestamp int64  `json:"time"`
 	Publisher string `json:"publisher"`
 	Scrape    []byte
+
+	// Labels are additional grouping labels for the Push Gateway
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Method is how the scrape is pushed to the Push Gateway, PUT replaces the
+	// whole group, DELETE removes it and POST, the default, replaces the metrics
+	// with the same names
+	Method string `json:"method,omitempty"`
+
+	Certificate []byte `json:"certificate,omitempty"`
+	Signature   []byte `json:"signature,omitempty"`
+
+	KeyID        string `json:"key_id,omitempty"`
+	EncryptedKey []byte `json:"encrypted_key,omitempty"`
+	Nonce        []byte `json:"nonce,omitempty"`
 }
 
-var outbox = make(chan Scrape, 1000)
-var restart = make(chan struct{}, 1)
-var stream *connection.Connection
-var hostname string
-var err error
+// Pausable is the circuit breaker of the poller started by Run
 var Pausable *circuitbreaker.Pausable
 
-func Run(ctx context.Context, wg *sync.WaitGroup, scrapeCfg *config.Config) {
+// Poller polls the configured jobs and publishes the results to the poller streams
+type Poller struct {
+	cfg     *config.Config
+	log     *logrus.Entry
+	outbox  chan Scrape
+	requeue chan *outgoing
+	streams []*pollerStream
+	signer  security.Provider
+	keyring *encryption.Keyring
+
+	remoteWrite *remoteWriteBuffer
+
+	// Pausable is the circuit breaker for the poller
+	Pausable *circuitbreaker.Pausable
+}
+
+// Run polls and publishes to supervised connections to every poller stream until ctx is cancelled
+func Run(ctx context.Context, wg *sync.WaitGroup, cfg *config.Config) {
 	defer wg.Done()
 
-	log = scrapeCfg.Log("poller")
+	log := cfg.Log("poller")
 
-	log.Infof("Choria Prometheus Streams Poller version %s starting with configuration file %s", build.Version, scrapeCfg.ConfigFile)
+	log.Infof("Choria Prometheus Streams Poller version %s starting with configuration file %s", build.Version, cfg.ConfigFile)
 
-	cfg = scrapeCfg
-	Pausable = circuitbreaker.New(pauseGauge)
+	transports := []connection.Transport{}
+	for _, scfg := range cfg.PollerStreams {
+		transports = append(transports, connection.NewSupervisor("poller_"+scfg.Name, scfg, cfg.Log("connector").WithField("poller_stream", scfg.Name)))
+	}
 
-	stream, err = connect(ctx, scrapeCfg)
+	p, err := New(cfg, transports)
 	if err != nil {
 		log.Errorf("Could not start scrape: %s", err)
 		return
 	}
 
-	jobsGauge.Set(float64(len(cfg.Jobs)))
+	Pausable = p.Pausable
+
+	p.Run(ctx, wg)
+}
+
+// New creates a poller that publishes to the poller streams using transports, one per
+// configured stream in the same order.  Supervised transports are run by the poller
+func New(cfg *config.Config, transports []connection.Transport) (*Poller, error) {
+	p := &Poller{
+		cfg:      cfg,
+		log:      cfg.Log("poller"),
+		outbox:   make(chan Scrape, 1000),
+		requeue:  make(chan *outgoing, 1000),
+		Pausable: circuitbreaker.New(pauseGauge),
+	}
+
+	var err error
+
+	if len(cfg.PollerStreams) == 0 {
+		return nil, fmt.Errorf("no poller_stream configured")
+	}
+
+	if len(transports) != len(cfg.PollerStreams) {
+		return nil, fmt.Errorf("%d transports given for %d poller streams", len(transports), len(cfg.PollerStreams))
+	}
+
+	if cfg.SignScrapes {
+		p.signer, err = cfg.PollerStream.TLS.SecurityProvider()
+		if err != nil {
+			return nil, fmt.Errorf("could not set up scrape signing: %s", err)
+		}
+	}
+
+	if cfg.Encryption != nil {
+		p.keyring, err = encryption.New(cfg.Encryption)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up scrape encryption: %s", err)
+		}
+
+		if !p.keyring.CanSeal() {
+			return nil, fmt.Errorf("could not set up scrape encryption: the first key has no shared or public key")
+		}
+	}
+
+	for i, scfg := range cfg.PollerStreams {
+		p.streams = append(p.streams, p.newPollerStream(scfg, transports[i]))
+	}
+
+	if cfg.PushEndpoint != nil && cfg.PushEndpoint.RemoteWrite {
+		p.remoteWrite = newRemoteWriteBuffer()
+	}
+
+	return p, nil
+}
+
+// Run polls the jobs and publishes the results until ctx is cancelled, polling
+// starts once at least one stream is connected
+func (p *Poller) Run(ctx context.Context, wg *sync.WaitGroup) {
+	connected := make(chan struct{}, len(p.streams))
+
+	for _, s := range p.streams {
+		s.start(ctx, wg, connected)
+
+		wg.Add(1)
+		go p.publisher(ctx, wg, s)
+	}
+
+	// scrapes are only started once at least one stream can take them
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return
+	}
+
+	jobsGauge.Set(float64(len(p.cfg.Jobs)))
 	pauseGauge.Set(0)
 
-	for name, job := range cfg.Jobs {
+	for name, job := range p.cfg.Jobs {
 		wg.Add(1)
-		go jobWorker(ctx, wg, name, job)
+		go p.jobWorker(ctx, wg, name, job)
+	}
+
+	if p.cfg.PushEndpoint != nil {
+		wg.Add(1)
+		go p.pushEndpoint(ctx, wg)
+	}
+
+	if p.remoteWrite != nil {
+		wg.Add(1)
+		go p.remoteWritePublisher(ctx, wg)
 	}
 
 	for {
 		select {
-		case <-restart:
-			stream, err = connect(ctx, scrapeCfg)
-			if err != nil {
-				log.Errorf("Could not start scrape: %s", err)
-				return
-			}
+		case m := <-p.outbox:
+			p.publish(ctx, m)
 
-		case m := <-outbox:
-			publish(m)
+		case o := <-p.requeue:
+			p.send(ctx, o)
 
 		case <-ctx.Done():
 			return
@@ -76,51 +188,151 @@ func Run(ctx context.Context, wg *sync.WaitGroup, scrapeCfg *config.Config) {
 	}
 }
 
-func connect(ctx context.Context, scrapeCfg *config.Config) (*connection.Connection, error) {
-	stream, err = connection.NewConnection(ctx, scrapeCfg.PollerStream, scrapeCfg.Log("connector"), func(_ stan.Conn, reason error) {
-		errorCtr.Inc()
-		log.Errorf("Stream connection disconnected, initiating reconnection: %s", reason)
-		restart <- struct{}{}
-	})
+// outgoing is a serialized scrape waiting to be published, when stream is set it
+// is only published to that stream else to the streams selected by poller_stream_mode
+type outgoing struct {
+	scrape Scrape
+	data   []byte
+	stream *pollerStream
+	tries  int
+}
 
+func (p *Poller) publish(ctx context.Context, m Scrape) {
+	j, err := json.Marshal(m)
 	if err != nil {
-		return nil, fmt.Errorf("Could not start scrape: %s", err)
+		p.log.Errorf("Could not publish data: %s", err)
+		errorCtr.Inc()
+		return
 	}
 
-	event, err := lifecycle.New(lifecycle.Startup, lifecycle.Identity(cfg.Hostname), lifecycle.Component("prometheus_streams_poller"), lifecycle.Version(build.Version))
-	if err != nil {
-		log.Errorf("Could not create startup lifecycle event: %s", err)
+	p.send(ctx, &outgoing{scrape: m, data: j})
+}
+
+// send hands a scrape to the publishers of the streams selected by poller_stream_mode,
+// each stream publishes from its own queue so a slow stream does not hold up others
+func (p *Poller) send(ctx context.Context, o *outgoing) {
+	targets := p.streams
+	if o.stream != nil {
+		targets = []*pollerStream{o.stream}
 	}
 
-	if event != nil {
-		err = lifecycle.PublishEvent(event, stream)
-		if err != nil {
-			log.Errorf("Could not publish lifecycle event: %s", err)
+	queued := false
+
+	for _, s := range targets {
+		if p.cfg.PollerStreamMode == "failover" && !s.connected() {
+			s.log.Debugf("Skipping stream that is not connected for job %s", o.scrape.Job)
+			continue
+		}
+
+		select {
+		case s.queue <- o:
+		default:
+			s.log.Errorf("Could not publish data for job %s: the publish queue is full", o.scrape.Job)
+			streamErrorCtr.WithLabelValues(s.cfg.Name).Inc()
+
+			if p.cfg.PollerStreamMode == "all" {
+				p.retry(o, s)
+			}
+
+			continue
+		}
+
+		queued = true
+
+		if p.cfg.PollerStreamMode == "failover" {
+			break
 		}
 	}
 
-	return stream, nil
+	if !queued && p.cfg.PollerStreamMode == "failover" {
+		p.log.Errorf("Could not publish data for job %s to any stream", o.scrape.Job)
+		p.retry(o, p.streams[0])
+	}
+}
+
+// publisher publishes the scrapes queued for a stream without waiting for
+// acknowledgement, publishes that fail or are not acknowledged are retried
+func (p *Poller) publisher(ctx context.Context, wg *sync.WaitGroup, s *pollerStream) {
+	defer wg.Done()
+
+	for {
+		select {
+		case o := <-s.queue:
+			p.publishTo(ctx, s, o)
+
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func publish(m Scrape) {
+func (p *Poller) publishTo(ctx context.Context, s *pollerStream, o *outgoing) {
 	obs := prometheus.NewTimer(publishTime)
 	defer obs.ObserveDuration()
 
-	j, err := json.Marshal(m)
-	if err != nil {
-		log.Errorf("Could not publish data: %s", err)
-		errorCtr.Inc()
+	subject := s.subject(&o.scrape)
+
+	err := s.publishAsync(ctx, subject, o.data, func(err error) {
+		if err != nil {
+			s.log.Errorf("Publishing %d bytes to %s for job %s failed: %s", len(o.data), subject, o.scrape.Job, err)
+			p.retry(o, s)
+			return
+		}
+
+		publishedCtr.Inc()
+	})
+
+	switch {
+	case err == nil:
+		p.log.Debugf("Published %d bytes to %s on stream %s for job %s", len(o.data), subject, s.cfg.Name, o.scrape.Job)
+		return
+	case err == connection.ErrNotConnected:
+		s.log.Debugf("Could not publish to stream that is not connected for job %s", o.scrape.Job)
+	case ctx.Err() != nil:
 		return
+	default:
+		s.log.Errorf("Could not publish data for job %s: %s", o.scrape.Job, err)
 	}
 
-	err = stream.Publish(cfg.PollerStream.Topic, j)
-	if err != nil {
-		log.Errorf("Could not publish data: %s", err)
+	p.retry(o, s)
+}
+
+// retry requeues a failed publish after a backoff, in all mode it is retried on
+// the stream that failed while failover mode can pick any stream
+func (p *Poller) retry(o *outgoing, s *pollerStream) {
+	if o.tries >= s.cfg.PublishRetries {
+		p.log.Errorf("Discarding scrape for job %s after %d failed publish attempts", o.scrape.Job, o.tries+1)
 		errorCtr.Inc()
 		return
 	}
 
-	publishedCtr.Inc()
+	r := &outgoing{
+		scrape: o.scrape,
+		data:   o.data,
+		tries:  o.tries + 1,
+	}
+
+	if p.cfg.PollerStreamMode == "all" {
+		r.stream = s
+	}
+
+	time.AfterFunc(s.cfg.BackoffPolicy.Duration(r.tries), func() {
+		select {
+		case p.requeue <- r:
+		default:
+			p.log.Errorf("Discarding scrape for job %s, the retry queue is full", o.scrape.Job)
+			errorCtr.Inc()
+		}
+	})
+}
+
+// Body is the uncompressed exposition format data in the scrape
+func (s *Scrape) Body() ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(s.Scrape))
+	if err != nil {
+		return []byte{}, err
+	}
+	defer r.Close()
 
-	log.Debugf("Published %d bytes to %s for job %s", len(j), cfg.PollerStream.Topic, m.Job)
+	return ioutil.ReadAll(r)
 }
@@ -0,0 +1,204 @@
+package scrape
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/circuitbreaker"
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/sirupsen/logrus"
+)
+
+// testConfig loads yaml as a configuration file with logging discarded
+func testConfig(t *testing.T, yaml string) *config.Config {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := ioutil.WriteFile(file, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+
+	cfg, err := config.NewConfig(file)
+	if err != nil {
+		t.Fatalf("invalid config: %s", err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	cfg.Logger = logrus.NewEntry(logger)
+
+	return cfg
+}
+
+func TestPollerPublishes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer target.Close()
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+identity: poller.example.net
+jobs:
+  web:
+    targets:
+      - name: web1
+        url: %s
+poller_stream:
+  cluster_id: %s
+  topic: prometheus
+  transport: memory
+`, target.URL, t.Name()))
+
+	conn, err := connection.NewMemory(ctx, cfg.PollerStream, cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	msgs := make(chan *connection.Message, 10)
+	conn.Subscribe("prometheus", connection.SubscribeOptions{}, func(msg *connection.Message) { msgs <- msg })
+
+	p, err := New(cfg, []connection.Transport{conn})
+	if err != nil {
+		t.Fatalf("could not create poller: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	go p.Run(ctx, wg)
+
+	var msg *connection.Message
+
+	// the poller announces itself before publishing scrapes
+	for msg == nil || msg.Subject != "prometheus" {
+		select {
+		case msg = <-msgs:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no scrape was published")
+		}
+	}
+
+	sc := Scrape{}
+
+	err = json.Unmarshal(msg.Data, &sc)
+	if err != nil {
+		t.Fatalf("invalid scrape: %s", err)
+	}
+
+	if sc.Job != "web" || sc.Instance != "web1" || sc.Publisher != "poller.example.net" {
+		t.Fatalf("unexpected scrape %s/%s from %s", sc.Job, sc.Instance, sc.Publisher)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(sc.Scrape))
+	if err != nil {
+		t.Fatalf("invalid compressed body: %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(gz)
+	if string(body) != "up 1\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestPushTooLarge(t *testing.T) {
+	cfg := testConfig(t, `
+scrape_interval: 1m
+poller_stream:
+  topic: prometheus
+  transport: memory
+push_endpoint:
+  port: 9091
+  max_size: 10
+`)
+
+	p := &Poller{cfg: cfg, log: cfg.Log("poller"), Pausable: circuitbreaker.New(pauseGauge)}
+
+	w := httptest.NewRecorder()
+	p.pushHandler(w, httptest.NewRequest(http.MethodPost, "/metrics/job/batch", bytes.NewReader([]byte("up 1\nbatch_last_run 1\n"))))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413 got %d", w.Code)
+	}
+}
+
+// stalled is a transport that never acknowledges publishes
+type stalled struct {
+	connection.Transport
+}
+
+func (s *stalled) PublishAsync(subject string, data []byte, ack func(err error)) error {
+	return nil
+}
+
+func TestSlowStreamDoesNotBlockOthers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := testConfig(t, fmt.Sprintf(`
+scrape_interval: 1m
+poller_stream:
+  - name: slow
+    cluster_id: %[1]s_slow
+    topic: prometheus
+    transport: memory
+    publish_max_inflight: 1
+  - name: fast
+    cluster_id: %[1]s_fast
+    topic: prometheus
+    transport: memory
+`, t.Name()))
+
+	slow, err := connection.NewMemory(ctx, cfg.PollerStreams[0], cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	fast, err := connection.NewMemory(ctx, cfg.PollerStreams[1], cfg.Log("connector"))
+	if err != nil {
+		t.Fatalf("could not create transport: %s", err)
+	}
+
+	msgs := make(chan *connection.Message, 10)
+	fast.Subscribe("prometheus", connection.SubscribeOptions{}, func(msg *connection.Message) { msgs <- msg })
+
+	p, err := New(cfg, []connection.Transport{&stalled{slow}, fast})
+	if err != nil {
+		t.Fatalf("could not create poller: %s", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+
+	go p.Run(ctx, wg)
+
+	for i := 0; i < 3; i++ {
+		p.outbox <- Scrape{Job: "web", Instance: fmt.Sprintf("web%d", i)}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-msgs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of 3 scrapes on the fast stream", i)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -14,103 +16,178 @@ import (
 	"golang.org/x/net/context/ctxhttp"
 )
 
-func jobWorker(ctx context.Context, wg *sync.WaitGroup, name string, job *config.Job) {
+// result is the exposition format data fetched for a single instance
+type result struct {
+	instance string
+	labels   map[string]string
+	method   string
+	body     []byte
+}
+
+// fetcher retrieves the data for a target, the context times out after the scrape interval
+type fetcher func(ctx context.Context, jobname string, target *config.Target) ([]result, error)
+
+func (p *Poller) jobWorker(ctx context.Context, wg *sync.WaitGroup, name string, job *config.Job) {
 	defer wg.Done()
 
 	targetGauge.WithLabelValues(name).Set(float64(len(job.Targets)))
 
 	for _, target := range job.Targets {
 		wg.Add(1)
-		go targetWorker(ctx, wg, name, target)
+		go p.targetWorker(ctx, wg, name, job, target)
 	}
 }
 
-func targetWorker(ctx context.Context, wg *sync.WaitGroup, jobname string, target *config.Target) {
+func (p *Poller) newFetcher(job *config.Job, target *config.Target) fetcher {
+	switch job.Type {
+	case "textfile":
+		return p.fetchTextfile
+	case "exec":
+		return fetchExec
+	case "probe":
+		return p.fetchProbe
+	default:
+		return newHTTPFetcher(target)
+	}
+}
+
+func (p *Poller) targetWorker(ctx context.Context, wg *sync.WaitGroup, jobname string, job *config.Job, target *config.Target) {
 	defer wg.Done()
 
-	interval, err := time.ParseDuration(cfg.Interval)
+	interval, err := time.ParseDuration(p.cfg.Interval)
 	if err != nil {
-		log.Errorf("Could not parse interval '%s', defaulting to 30s: %s", cfg.Interval, err)
+		p.log.Errorf("Could not parse interval '%s', defaulting to 30s: %s", p.cfg.Interval, err)
 		interval = time.Duration(30 * time.Second)
 	}
-	client := &http.Client{}
+
+	fetch := p.newFetcher(job, target)
 
 	poll := func() {
 		obs := prometheus.NewTimer(pollTime.WithLabelValues(jobname, target.Name))
 		defer obs.ObserveDuration()
 
-		if Pausable.Paused() && jobname != "prometheus_streams" {
-			log.Warnf("Skipping poll for job %s while paused", jobname)
+		if p.Pausable.Paused() && jobname != "prometheus_streams" {
+			p.log.Warnf("Skipping poll for job %s while paused", jobname)
 			return
 		}
 
-		log.Debugf("Polling job %s %s @ %s", jobname, target.Name, target.URL)
+		p.log.Debugf("Polling job %s %s @ %s", jobname, target.Name, target.Source())
 
 		timeout, cancel := context.WithTimeout(ctx, interval)
 		defer cancel()
 
-		resp, err := ctxhttp.Get(timeout, client, target.URL)
-
+		results, err := fetch(timeout, jobname, target)
 		if err != nil {
-			log.Errorf("Could not fetch %s: %s", target.URL, err)
+			p.log.Errorf("Could not fetch %s: %s", target.Source(), err)
 			pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
 			return
 		}
 
-		if resp == nil {
-			log.Errorf("Could not fetch %s: unknown error", target.URL)
-			pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
-			return
+		for _, r := range results {
+			pollSizeCtr.WithLabelValues(jobname, target.Name).Add(float64(len(r.body)))
+
+			err = p.enqueue(jobname, r)
+			if err != nil {
+				p.log.Errorf("Could not publish result for %s: %s", target.Source(), err)
+				pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
+			}
 		}
 
-		if resp.StatusCode >= 300 {
-			log.Errorf("Could not fetch %s: %s", target.URL, resp.Status)
-			pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
+		p.log.Debugf("Completed poll of job %s", jobname)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.log.Infof("Polling %s using %s every %s", target.Name, target.Source(), interval)
+
+	poll()
+
+	for {
+		select {
+		case <-ticker.C:
+			poll()
+		case <-ctx.Done():
 			return
 		}
+	}
+}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+// enqueue compresses, encrypts and signs a result and places it in the outbox
+func (p *Poller) enqueue(jobname string, r result) error {
+	cbody, err := compress(r.body)
+	if err != nil {
+		return fmt.Errorf("could not compress: %s", err)
+	}
+
+	sc := Scrape{
+		Job:       jobname,
+		Instance:  r.instance,
+		Timestamp: time.Now().UTC().Unix(),
+		Scrape:    cbody,
+		Publisher: p.cfg.Hostname,
+		Labels:    r.labels,
+		Method:    r.method,
+	}
+
+	if p.keyring != nil {
+		err = sc.Encrypt(p.keyring)
 		if err != nil {
-			log.Errorf("Could not read body of %s: %s", target.URL, err)
-			pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
-			return
+			return fmt.Errorf("could not encrypt: %s", err)
 		}
+	}
 
-		pollSizeCtr.WithLabelValues(jobname, target.Name).Add(float64(len(body)))
-
-		cbody, err := compress(body)
+	if p.signer != nil {
+		err = sc.Sign(p.signer)
 		if err != nil {
-			log.Errorf("Could not compress result for %s: %s", target.URL, err)
-			pollErrCtr.WithLabelValues(jobname, target.Name).Inc()
-			return
+			return fmt.Errorf("could not sign: %s", err)
 		}
+	}
+
+	p.outbox <- sc
+
+	return nil
+}
 
-		outbox <- Scrape{
-			Job:       jobname,
-			Instance:  target.Name,
-			Timestamp: time.Now().UTC().Unix(),
-			Scrape:    cbody,
-			Publisher: cfg.Hostname,
+// newHTTPFetcher creates a fetcher for http targets, targets on unix sockets
+// are fetched using a transport that always dials the socket
+func newHTTPFetcher(target *config.Target) fetcher {
+	client := &http.Client{}
+	url := target.URL
+
+	if socket, path, ok := target.UnixSocket(); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
 		}
 
-		log.Debugf("Completed poll of job %s", jobname)
+		url = "http://unix" + path
 	}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	return func(ctx context.Context, jobname string, target *config.Target) ([]result, error) {
+		resp, err := ctxhttp.Get(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
 
-	log.Infof("Polling %s using url %s every %s", target.Name, target.URL, interval)
+		if resp == nil {
+			return nil, fmt.Errorf("unknown error")
+		}
 
-	poll()
+		defer resp.Body.Close()
 
-	for {
-		select {
-		case <-ticker.C:
-			poll()
-		case <-ctx.Done():
-			return
+		if resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read body: %s", err)
 		}
+
+		return []result{{instance: target.Name, body: body}}, nil
 	}
 }
 
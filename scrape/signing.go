@@ -0,0 +1,90 @@
+package scrape
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	security "github.com/choria-io/go-security"
+)
+
+// Sign signs the scrape using the certificate of the security provider and
+// embeds the certificate so receivers can verify it
+func (s *Scrape) Sign(prov security.Provider) error {
+	cert, err := prov.PublicCertTXT()
+	if err != nil {
+		return fmt.Errorf("could not retrieve public certificate: %s", err)
+	}
+
+	sig, err := prov.SignBytes(s.signable())
+	if err != nil {
+		return fmt.Errorf("could not sign scrape: %s", err)
+	}
+
+	s.Certificate = cert
+	s.Signature = sig
+
+	return nil
+}
+
+// Signed determines if the scrape carries a signature
+func (s *Scrape) Signed() bool {
+	return len(s.Signature) > 0
+}
+
+// Verify checks that the embedded certificate is signed by the CA of the security
+// provider, that it belongs to the publisher and that it signed the scrape
+func (s *Scrape) Verify(prov security.Provider) error {
+	if !s.Signed() {
+		return errors.New("scrape is not signed")
+	}
+
+	err := prov.VerifyCertificate(s.Certificate, s.Publisher)
+	if err != nil {
+		return fmt.Errorf("certificate is not valid for publisher %s: %s", s.Publisher, err)
+	}
+
+	block, _ := pem.Decode(s.Certificate)
+	if block == nil {
+		return errors.New("could not decode certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("could not parse certificate: %s", err)
+	}
+
+	pubkey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("certificate does not hold a RSA public key")
+	}
+
+	hashed := sha256.Sum256(s.signable())
+
+	err = rsa.VerifyPKCS1v15(pubkey, crypto.SHA256, hashed[:], s.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	return nil
+}
+
+// signable is the data covered by the signature
+func (s *Scrape) signable() []byte {
+	header := fmt.Sprintf("%s\n%s\n%s\n%d\n%s\n", s.Publisher, s.Job, s.Instance, s.Timestamp, s.KeyID)
+
+	for _, name := range s.labelNames() {
+		header = header + fmt.Sprintf("%s=%s\n", name, s.Labels[name])
+	}
+
+	// only covered when set so scrapes signed before methods were added still verify
+	if s.Method != "" {
+		header = header + fmt.Sprintf("method=%s\n", s.Method)
+	}
+
+	return append([]byte(header), s.Scrape...)
+}
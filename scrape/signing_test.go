@@ -0,0 +1,208 @@
+package scrape
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	security "github.com/choria-io/go-security"
+)
+
+// testCA issues certificates for test providers
+type testCA struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create CA: %s", err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{key: key, cert: cert}
+}
+
+// testProvider is a security provider holding a certificate for identity issued by ca
+type testProvider struct {
+	security.Provider
+
+	ca   *testCA
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func (ca *testCA) provider(t *testing.T, identity string) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: identity},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+
+	return &testProvider{
+		ca:   ca,
+		key:  key,
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (p *testProvider) PublicCertTXT() ([]byte, error) {
+	return p.cert, nil
+}
+
+func (p *testProvider) SignBytes(b []byte) ([]byte, error) {
+	hashed := sha256.Sum256(b)
+	return rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hashed[:])
+}
+
+func (p *testProvider) VerifyCertificate(certpem []byte, identity string) error {
+	block, _ := pem.Decode(certpem)
+	if block == nil {
+		return errors.New("could not decode certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca.cert)
+
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return err
+	}
+
+	if cert.Subject.CommonName != identity {
+		return fmt.Errorf("certificate is for %s", cert.Subject.CommonName)
+	}
+
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t)
+	poller := ca.provider(t, "poller.example.net")
+	other := ca.provider(t, "other.example.net")
+	rogue := newTestCA(t).provider(t, "poller.example.net")
+
+	signed := func(prov security.Provider) *Scrape {
+		s := &Scrape{
+			Job:       "web",
+			Instance:  "web1",
+			Timestamp: time.Now().Unix(),
+			Publisher: "poller.example.net",
+			Labels:    map[string]string{"dc": "dc1"},
+			Scrape:    []byte("up 1\n"),
+		}
+
+		err := s.Sign(prov)
+		if err != nil {
+			t.Fatalf("could not sign: %s", err)
+		}
+
+		return s
+	}
+
+	cases := []struct {
+		name   string
+		scrape func() *Scrape
+		valid  bool
+	}{
+		{name: "valid", scrape: func() *Scrape { return signed(poller) }, valid: true},
+		{name: "missing signature", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Signature = nil
+			return s
+		}},
+		{name: "tampered body", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Scrape = []byte("up 0\n")
+			return s
+		}},
+		{name: "tampered job", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Job = "db"
+			return s
+		}},
+		{name: "tampered label", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Labels["dc"] = "dc2"
+			return s
+		}},
+		{name: "wrong publisher", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Publisher = "other.example.net"
+			return s
+		}},
+		{name: "certificate of another publisher", scrape: func() *Scrape {
+			s := signed(other)
+			s.Publisher = "poller.example.net"
+			return s
+		}},
+		{name: "signed by another key", scrape: func() *Scrape {
+			s := signed(poller)
+			s.Signature = signed(other).Signature
+			return s
+		}},
+		{name: "certificate from another CA", scrape: func() *Scrape { return signed(rogue) }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.scrape().Verify(poller)
+
+			if c.valid && err != nil {
+				t.Fatalf("valid scrape was rejected: %s", err)
+			}
+
+			if !c.valid && err == nil {
+				t.Fatalf("invalid scrape was accepted")
+			}
+		})
+	}
+}
@@ -50,6 +50,52 @@ var (
 		Help: "Indicates if the poller is paused",
 	})
 
+	textfileErrCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_textfile_skipped",
+		Help: "Text files that were skipped because they were invalid or stale",
+	}, []string{"poller_job", "poller_target"})
+
+	execExitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_streams_poller_exec_exit_code",
+		Help: "The exit code of the last run of an exec target, -1 when it timed out or could not be started",
+	}, []string{"poller_job", "poller_target"})
+
+	pushReceivedCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_pushes_received",
+		Help: "Metrics pushed to the poller push endpoint",
+	}, []string{"poller_job"})
+
+	pushErrCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_push_errors",
+		Help: "Errors encountered while handling metrics pushed to the poller push endpoint",
+	}, []string{"poller_job"})
+
+	remoteWriteCtr = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_remote_write_series",
+		Help: "Series received using remote write",
+	})
+
+	remoteWriteErrCtr = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_remote_write_errors",
+		Help: "Errors encountered while handling remote write requests",
+	})
+
+	streamPublishedCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_stream_published_count",
+		Help: "How many messages containing scrapes were published to a stream",
+	}, []string{"poller_stream"})
+
+	streamErrorCtr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_streams_poller_stream_publish_errors",
+		Help: "Errors encountered during publishes to a stream",
+	}, []string{"poller_stream"})
+
+	ackTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_streams_poller_publish_ack_time",
+		Help:    "How long it took for a stream to acknowledge published messages",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"poller_stream"})
+
 	targetGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "prometheus_streams_poller_targets",
 		Help: "How many targets are configured",
@@ -67,4 +113,13 @@ func init() {
 	prometheus.MustRegister(compressTime)
 	prometheus.MustRegister(pollTime)
 	prometheus.MustRegister(pollSizeCtr)
+	prometheus.MustRegister(textfileErrCtr)
+	prometheus.MustRegister(execExitGauge)
+	prometheus.MustRegister(pushReceivedCtr)
+	prometheus.MustRegister(pushErrCtr)
+	prometheus.MustRegister(remoteWriteCtr)
+	prometheus.MustRegister(remoteWriteErrCtr)
+	prometheus.MustRegister(streamPublishedCtr)
+	prometheus.MustRegister(streamErrorCtr)
+	prometheus.MustRegister(ackTime)
 }
@@ -0,0 +1,164 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	lifecycle "github.com/choria-io/go-lifecycle"
+	"github.com/choria-io/prometheus-streams/build"
+	"github.com/choria-io/prometheus-streams/config"
+	"github.com/choria-io/prometheus-streams/connection"
+	"github.com/sirupsen/logrus"
+)
+
+var errAckTimeout = errors.New("timeout waiting for acknowledgement")
+
+// pollerStream is one of the streams scrapes are published to, each has its own
+// supervised connection so a broken stream does not affect the others
+type pollerStream struct {
+	cfg      *config.StreamConfig
+	conn     connection.Transport
+	queue    chan *outgoing
+	inflight chan struct{}
+	hostname string
+	log      *logrus.Entry
+}
+
+func (p *Poller) newPollerStream(scfg *config.StreamConfig, conn connection.Transport) *pollerStream {
+	return &pollerStream{
+		cfg:      scfg,
+		conn:     conn,
+		queue:    make(chan *outgoing, 1000),
+		inflight: make(chan struct{}, scfg.PublishMaxInflight),
+		hostname: p.cfg.Hostname,
+		log:      p.log.WithField("poller_stream", scfg.Name),
+	}
+}
+
+// start runs a supervised connection and signals connected once it first connects,
+// other transports are already connected
+func (s *pollerStream) start(ctx context.Context, wg *sync.WaitGroup, connected chan struct{}) {
+	supervisor, ok := s.conn.(*connection.Supervisor)
+	if !ok {
+		s.announce(s.conn)
+		connected <- struct{}{}
+		return
+	}
+
+	supervisor.OnConnect(s.announce)
+
+	wg.Add(1)
+	go supervisor.Run(ctx, wg)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if supervisor.WaitConnected(ctx) == nil {
+			connected <- struct{}{}
+		}
+	}()
+}
+
+// connected determines if the stream can currently be published to
+func (s *pollerStream) connected() bool {
+	supervisor, ok := s.conn.(*connection.Supervisor)
+	if !ok {
+		return true
+	}
+
+	return supervisor.IsConnected()
+}
+
+// announce publishes a startup lifecycle event after every connection
+func (s *pollerStream) announce(conn connection.Transport) {
+	event, err := lifecycle.New(lifecycle.Startup, lifecycle.Identity(s.hostname), lifecycle.Component("prometheus_streams_poller"), lifecycle.Version(build.Version))
+	if err != nil {
+		s.log.Errorf("Could not create startup lifecycle event: %s", err)
+		return
+	}
+
+	err = lifecycle.PublishEvent(event, conn)
+	if err != nil {
+		s.log.Errorf("Could not publish lifecycle event: %s", err)
+	}
+}
+
+// subjectReplacer makes values safe to use as a single subject token
+var subjectReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_", "/", "_")
+
+func subjectToken(v string) string {
+	if v == "" {
+		return "none"
+	}
+
+	return subjectReplacer.Replace(v)
+}
+
+// subject is the topic with any template placeholders replaced by values from the scrape
+func (s *pollerStream) subject(m *Scrape) string {
+	if !strings.Contains(s.cfg.Topic, "{{") {
+		return s.cfg.Topic
+	}
+
+	return strings.NewReplacer(
+		"{{publisher}}", subjectToken(m.Publisher),
+		"{{job}}", subjectToken(m.Job),
+		"{{instance}}", subjectToken(m.Instance),
+	).Replace(s.cfg.Topic)
+}
+
+// publishAsync publishes data without waiting for the stream to store it, once
+// publish_max_inflight messages are waiting for acknowledgement further publishes
+// to this stream block.  done is called once with the outcome or a timeout error
+func (s *pollerStream) publishAsync(ctx context.Context, subject string, data []byte, done func(error)) error {
+	if !s.connected() {
+		streamErrorCtr.WithLabelValues(s.cfg.Name).Inc()
+		return connection.ErrNotConnected
+	}
+
+	select {
+	case s.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	start := time.Now()
+	once := sync.Once{}
+
+	finish := func(err error, notify bool) {
+		once.Do(func() {
+			<-s.inflight
+
+			if err != nil {
+				streamErrorCtr.WithLabelValues(s.cfg.Name).Inc()
+			} else {
+				streamPublishedCtr.WithLabelValues(s.cfg.Name).Inc()
+				ackTime.WithLabelValues(s.cfg.Name).Observe(time.Since(start).Seconds())
+			}
+
+			if notify {
+				done(err)
+			}
+		})
+	}
+
+	timer := time.AfterFunc(s.cfg.PublishAckTimeoutDuration, func() {
+		finish(errAckTimeout, true)
+	})
+
+	err := s.conn.PublishAsync(subject, data, func(err error) {
+		timer.Stop()
+		finish(err, true)
+	})
+	if err != nil {
+		timer.Stop()
+		finish(err, false)
+		return err
+	}
+
+	return nil
+}
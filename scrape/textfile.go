@@ -0,0 +1,145 @@
+package scrape
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/choria-io/prometheus-streams/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fetchTextfile reads node_exporter style *.prom files from a directory, files
+// that are invalid or older than the stale setting are skipped.  Either every
+// file is its own instance or all files are merged into a single instance
+func (p *Poller) fetchTextfile(ctx context.Context, jobname string, target *config.Target) ([]result, error) {
+	_, err := os.Stat(target.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(target.Directory, "*.prom"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	results := []result{}
+	merged := make(map[string]*dto.MetricFamily)
+
+	for _, file := range files {
+		families, body, err := readTextfile(file, target.StaleDuration)
+		if err != nil {
+			p.log.Warnf("Skipping %s for job %s: %s", file, jobname, err)
+			textfileErrCtr.WithLabelValues(jobname, target.Name).Inc()
+			continue
+		}
+
+		if target.PerFile {
+			results = append(results, result{
+				instance: strings.TrimSuffix(filepath.Base(file), ".prom"),
+				body:     body,
+			})
+
+			continue
+		}
+
+		err = mergeFamilies(merged, families)
+		if err != nil {
+			p.log.Warnf("Skipping %s for job %s: %s", file, jobname, err)
+			textfileErrCtr.WithLabelValues(jobname, target.Name).Inc()
+			continue
+		}
+	}
+
+	if target.PerFile {
+		return results, nil
+	}
+
+	if len(merged) == 0 {
+		return nil, fmt.Errorf("no valid files found")
+	}
+
+	body, err := encodeFamilies(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	return []result{{instance: target.Name, body: body}}, nil
+}
+
+func readTextfile(file string, stale time.Duration) (map[string]*dto.MetricFamily, []byte, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if stale > 0 && time.Since(stat.ModTime()) > stale {
+		return nil, nil, fmt.Errorf("last modified %s ago which is older than %s", time.Since(stat.ModTime()).Round(time.Second), stale)
+	}
+
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid exposition format: %s", err)
+	}
+
+	return families, body, nil
+}
+
+// mergeFamilies adds the metrics of a file to merged, when any metric conflicts with
+// one merged before nothing from the file is added
+func mergeFamilies(merged map[string]*dto.MetricFamily, families map[string]*dto.MetricFamily) error {
+	for name, family := range families {
+		existing, ok := merged[name]
+		if ok && existing.GetType() != family.GetType() {
+			return fmt.Errorf("metric %s is a %s but was previously seen as a %s", name, family.GetType(), existing.GetType())
+		}
+	}
+
+	for name, family := range families {
+		existing, ok := merged[name]
+		if !ok {
+			merged[name] = family
+			continue
+		}
+
+		existing.Metric = append(existing.Metric, family.Metric...)
+	}
+
+	return nil
+}
+
+func encodeFamilies(families map[string]*dto.MetricFamily) ([]byte, error) {
+	names := []string{}
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var b bytes.Buffer
+
+	for _, name := range names {
+		_, err := expfmt.MetricFamilyToText(&b, families[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,60 @@
+package scrape
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/choria-io/prometheus-streams/config"
+)
+
+func TestTextfileSkipsConflictingFileEntirely(t *testing.T) {
+	cfg := testConfig(t, `
+scrape_interval: 1m
+poller_stream:
+  topic: prometheus
+  transport: memory
+`)
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"a.prom": "# TYPE jobs_total counter\njobs_total 10\n",
+		"b.prom": "# TYPE backups gauge\nbackups 1\n# TYPE jobs_total gauge\njobs_total 5\n",
+		"c.prom": "# TYPE jobs_total counter\njobs_total{queue=\"low\"} 2\n",
+	}
+
+	for name, body := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0600)
+		if err != nil {
+			t.Fatalf("could not write %s: %s", name, err)
+		}
+	}
+
+	p := &Poller{cfg: cfg, log: cfg.Log("poller")}
+
+	results, err := p.fetchTextfile(context.Background(), "batch", &config.Target{Name: "node1", Directory: dir})
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result got %d", len(results))
+	}
+
+	body := string(results[0].body)
+
+	if strings.Contains(body, "backups") {
+		t.Fatalf("metrics from the skipped file were published:\n%s", body)
+	}
+
+	if !strings.Contains(body, "jobs_total 10") || !strings.Contains(body, `jobs_total{queue="low"} 2`) {
+		t.Fatalf("metrics from valid files are missing:\n%s", body)
+	}
+
+	if strings.Contains(body, "jobs_total 5") {
+		t.Fatalf("conflicting metric was published:\n%s", body)
+	}
+}